@@ -7,11 +7,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"syscall"
+	"time"
+	// Time zones for msd_schedule, the Docker image doesn't include them.
+	_ "time/tzdata"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/otel/sdk/resource"
@@ -19,6 +26,7 @@ import (
 
 	"github.com/G-Research/prommsd/pkg/alertchecker"
 	"github.com/G-Research/prommsd/pkg/alerthook"
+	"github.com/G-Research/prommsd/pkg/logging"
 	"github.com/G-Research/prommsd/pkg/tracing"
 )
 
@@ -26,9 +34,16 @@ var (
 	flagListenAddr  = flag.String("listen", ":9799", "Where to listen for HTTP requests")
 	flagExternalURL = flag.String("external-url", "", "URL where this is accessible to users")
 	flagVersion     = flag.Bool("version", false, "Print version information")
+
+	flagShutdownTimeout   = flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for requests and alert deliveries in progress to complete on shutdown")
+	flagShutdownStateFile = flag.String("shutdown-state-file", "", "File to write the final state of instances to (as JSON) on shutdown, and restore them from on startup")
 )
 
 func main() {
+	config := alertchecker.DefaultConfig()
+	config.RegisterFlags(flag.CommandLine)
+	logConfig := logging.DefaultConfig()
+	logConfig.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *flagVersion {
@@ -36,7 +51,20 @@ func main() {
 		os.Exit(0)
 	}
 
-	ctx := context.Background()
+	if err := logging.Setup(os.Stderr, logConfig); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot initialise logging: %v\n", err)
+		os.Exit(2)
+	}
+
+	if err := run(config); err != nil {
+		slog.Error("Exiting", logging.Err(err))
+		os.Exit(1)
+	}
+}
+
+func run(config alertchecker.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	shutdownTracing, err := tracing.SetProviderFromEnv(
 		ctx,
@@ -46,14 +74,19 @@ func main() {
 		),
 	)
 	if err != nil {
-		log.Fatalf("Cannot initialise tracing: %v", err)
+		return fmt.Errorf("cannot initialise tracing: %w", err)
 	}
-	defer shutdownTracing(ctx)
 
 	reg := prometheus.DefaultRegisterer
 	reg.MustRegister(prometheus.NewBuildInfoCollector())
 
 	externalURL := *flagExternalURL
+	if len(externalURL) == 0 && config.Peers != "" {
+		return errors.New("-external-url must be set with -peers, it identifies this replica to its peers")
+	}
+	if config.PeerToken == "" && config.Peers != "" {
+		return errors.New("-peer-token-file must be set with -peers, peers authenticate with it")
+	}
 	if len(externalURL) == 0 {
 		if (*flagListenAddr)[0] == ':' {
 			externalURL = "http://localhost" + *flagListenAddr
@@ -62,8 +95,52 @@ func main() {
 		}
 	}
 
-	alertChecker := alertchecker.New(reg, externalURL)
-	alerthook.Serve(*flagListenAddr, alertChecker, reg)
+	alertChecker, err := alertchecker.New(
+		alertchecker.WithConfig(config),
+		alertchecker.WithRegisterer(reg),
+		alertchecker.WithExternalURL(externalURL))
+	if err != nil {
+		return err
+	}
+	if *flagShutdownStateFile != "" {
+		state, err := os.ReadFile(*flagShutdownStateFile)
+		if err == nil {
+			err = alertChecker.Restore(state)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Cannot restore state, starting without it", logging.Err(err))
+		}
+	}
+	// Run until Shutdown, so checks carry on while the HTTP server drains.
+	go alertChecker.Run(context.Background())
+	// Recovering can take a while, heartbeats are received meanwhile and
+	// /-/ready fails until it is done.
+	go func() {
+		if err := alertChecker.Recover(ctx); err != nil {
+			slog.Error("Cannot recover from Alertmanager", logging.Err(err))
+		}
+	}()
+	if *flagShutdownStateFile != "" {
+		alertChecker.OnShutdown(func(_ context.Context, state []byte) error {
+			return os.WriteFile(*flagShutdownStateFile, state, 0o644)
+		})
+	}
+
+	serveErr := alerthook.Serve(ctx, *flagListenAddr, alertChecker, alertChecker.Handler(), reg, *flagShutdownTimeout)
+	stop()
+	slog.Info("Shutting down")
+
+	// No more heartbeats are arriving, let deliveries in progress finish before
+	// flushing any remaining spans.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+	defer cancel()
+	if err := alertChecker.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Alert checker shutdown failed", logging.Err(err))
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Tracing shutdown failed", logging.Err(err))
+	}
+	return serveErr
 }
 
 func showVersion() {
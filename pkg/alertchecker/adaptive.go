@@ -0,0 +1,89 @@
+package alertchecker
+
+import (
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/G-Research/prommsd/pkg/alertmanager"
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+const (
+	// Minimum number of heartbeat intervals seen before the learned activation
+	// is used.
+	adaptiveMinSamples = 10
+
+	defaultActivationMin = 1 * time.Minute
+	defaultActivationMax = 1 * time.Hour
+)
+
+// parseAdaptive parses the adaptive activation annotations of alert into
+// instance.
+func parseAdaptive(alert *alertmanager.Alert, instance *instanceDetails) {
+	instance.Adaptive = true
+	instance.ActivationMin = defaultActivationMin
+	instance.ActivationMax = defaultActivationMax
+	if s, ok := alert.GetAnnotation("msd_activation_min"); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			slog.Warn("Failed to parse msd_activation_min, using default", slog.String(logging.KeyInstance, instance.Key), logging.Err(err), slog.Duration("default", defaultActivationMin))
+		} else {
+			instance.ActivationMin = d
+		}
+	}
+	if s, ok := alert.GetAnnotation("msd_activation_max"); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			slog.Warn("Failed to parse msd_activation_max, using default", slog.String(logging.KeyInstance, instance.Key), logging.Err(err), slog.Duration("default", defaultActivationMax))
+		} else {
+			instance.ActivationMax = d
+		}
+	}
+}
+
+// recordInterval records the time since the previous heartbeat of
+// oldInstance for adaptive instances and sets the activation time from the
+// learned activation. Other instances don't keep intervals.
+func (c *Config) recordInterval(now time.Time, oldInstance, instance *instanceDetails) {
+	if oldInstance == nil || !instance.Adaptive {
+		return
+	}
+	instance.Intervals = append(oldInstance.Intervals, now.Sub(oldInstance.LastHeartbeat))
+	if len(instance.Intervals) > c.AdaptiveSamples {
+		instance.Intervals = instance.Intervals[len(instance.Intervals)-c.AdaptiveSamples:]
+	}
+
+	if learned, ok := c.learnActivation(instance.Intervals, instance.ActivationMin, instance.ActivationMax); ok {
+		instance.LearnedActivation = learned
+		instance.ActivateAt = now.Add(learned)
+	}
+}
+
+// learnActivation estimates the activation duration from the heartbeat
+// intervals, ok is false if there aren't enough intervals yet.
+func (c *Config) learnActivation(intervals []time.Duration, min, max time.Duration) (d time.Duration, ok bool) {
+	if len(intervals) < adaptiveMinSamples {
+		return 0, false
+	}
+	sorted := append([]time.Duration(nil), intervals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(math.Ceil(c.AdaptivePercentile*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	} else if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	d = time.Duration(float64(sorted[idx]) * c.AdaptiveFactor)
+
+	if d < min {
+		d = min
+	}
+	if d > max {
+		d = max
+	}
+	return d, true
+}
@@ -4,80 +4,247 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
+	oteltrace "go.opentelemetry.io/otel/trace"
+
 	"github.com/G-Research/prommsd/pkg/alertmanager"
+	"github.com/G-Research/prommsd/pkg/logging"
 )
 
-var (
-	flagSlackTemplate = flag.String("slack-template", "{{.Receiver}}:{{range $k, $v := .GroupLabels}} {{$k}}={{$v}}{{end}}{{range $k, $v := .CommonAnnotations}}\n{{$k}}: {{$v}}{{end}}", "Go text/template to use for formatting slack message")
-)
+// deliveryTimeout is the longest a single notification can take to send.
+const deliveryTimeout = 60 * time.Second
 
-func (ac *AlertChecker) sendAlerts(ctx context.Context, alertmanagers []string, receiver string, lastSent time.Time, resolved bool, groupLabels map[string]string, alert []alertmanager.Alert) error {
-	var lastErr error
-	t := "alert"
-	if resolved {
-		t = "resolved"
-	}
-	for _, alertURL := range alertmanagers {
-		u, err := url.Parse(alertURL)
-		if err != nil {
-			log.Printf("Unable to parse alert destination URL %q: %v", alertURL, err)
-			continue
-		}
+// outgoing is an alert to send to its destinations.
+type outgoing struct {
+	// ctx carries the alert's span and logging attributes.
+	ctx          context.Context
+	alert        alertmanager.Alert
+	groupLabels  map[string]string
+	destinations []string
+	receiver     string
+	lastSent     time.Time
+	// done is called with the last error sending the alert to any of its
+	// destinations, nil if all succeeded.
+	done func(err error)
+}
 
-		// Accept type+http:// to allow specifing the kind of service.
-		// Without + (e.g. http:// or https://) default to "am" (i.e.
-		// "alertmanager").
-		deliverType := "am"
-		extraScheme := strings.SplitN(u.Scheme, "+", 2)
-		if len(extraScheme) == 2 {
-			deliverType = extraScheme[0]
-			u.Scheme = extraScheme[1]
-		}
+// batch is alerts with the same receiver and status to send to a destination
+// in one notification.
+type batch struct {
+	destination string
+	deliverType string
+	url         *url.URL
+	notifier    Notifier
+	receiver    string
+	status      string
+	// items are indexes into the alerts being delivered.
+	items []int
+}
+
+// deliver queues the alerts to be sent, batching alerts for the same
+// destination into one request (up to MaxBatchSize) where the notifier
+// supports it. Each alert's done is called once all its batches have been
+// sent, a batch failing is attributed to every alert in it.
+func (ac *AlertChecker) deliver(ctx context.Context, pending []*outgoing) {
+	type batchKey struct {
+		destination, receiver, status string
+	}
+	open := map[batchKey]*batch{}
+	var batches []*batch
+	errs := make([]error, len(pending))
 
-		switch deliverType {
-		case "am":
-			func() {
-				client := alertmanager.NewClient(u)
-				ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
-				defer cancel()
-				log.Printf("Sending %s to %v", t, u)
-				err := client.SendAlerts(ctx, alert)
-				if err != nil {
-					log.Printf("Error sending %s to %v: %v", t, u, err)
-					lastErr = err
-				}
-			}()
-		case "webhook":
-			if err := sendWebhook(ctx, u, receiver, resolved, groupLabels, alert); err != nil {
-				log.Printf("Error sending %s to %v: %v", t, u, err)
-				lastErr = err
+	for i, o := range pending {
+		for _, alertURL := range o.destinations {
+			b, err := ac.parseDestination(alertURL)
+			if err != nil {
+				slog.ErrorContext(o.ctx, "Unable to use alert destination", logging.Err(err))
+				errs[i] = err
+				continue
 			}
-		case "slack":
-			if !ac.now().After(lastSent.Add(slackSendInterval)) {
-				// Avoid repeating slack notifications frequently. This may mean resolves aren't always
-				// sent, but this is better than a noisy alert, otherwise we're going to end up duplicating
-				// all of alertmanager's logic here...
+			capabilities := b.notifier.Capabilities()
+			status := o.alert.Status
+			if status == "resolved" && !capabilities.SupportsResolve {
 				continue
 			}
-			if err := sendSlack(ctx, u, receiver, resolved, groupLabels, alert); err != nil {
-				log.Printf("Error sending %s to %v: %v", t, u, err)
-				lastErr = err
+			if capabilities.MinRepeatInterval > 0 && status != "expired" && !ac.now().After(o.lastSent.Add(capabilities.MinRepeatInterval)) {
+				continue
+			}
+
+			key := batchKey{alertURL, o.receiver, status}
+			current := open[key]
+			if current == nil || !capabilities.Batch || (ac.config.MaxBatchSize > 0 && len(current.items) >= ac.config.MaxBatchSize) {
+				b.receiver = o.receiver
+				b.status = status
+				current = b
+				open[key] = current
+				batches = append(batches, current)
+			}
+			current.items = append(current.items, i)
+		}
+	}
+
+	remaining := make([]int, len(pending))
+	for _, b := range batches {
+		for _, i := range b.items {
+			remaining[i]++
+		}
+	}
+	var mu sync.Mutex
+	// finish records err for the alerts in items, calling done for each alert
+	// once all its batches are sent.
+	finish := func(items []int, err error) {
+		var finished []int
+		mu.Lock()
+		for _, i := range items {
+			if err != nil {
+				errs[i] = err
+			}
+			if remaining[i]--; remaining[i] <= 0 {
+				finished = append(finished, i)
 			}
-		default:
-			lastErr = fmt.Errorf("Unknown alert delivery type %v (in %q)", deliverType, alertURL)
-			log.Print(err)
 		}
+		mu.Unlock()
+		for _, i := range finished {
+			o := pending[i]
+			if errs[i] != nil {
+				slog.WarnContext(o.ctx, "Failed to deliver alert", deliveryErrorAttr(errs[i]))
+			}
+			o.done(errs[i])
+		}
+	}
+
+	var unsent []int
+	for i := range pending {
+		if remaining[i] == 0 {
+			unsent = append(unsent, i)
+		}
+	}
+	finish(unsent, nil)
+
+	for _, b := range batches {
+		b := b
+		ac.deliveries.enqueue(b.deliverType+" "+b.destination, func() {
+			ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+			defer cancel()
+			finish(b.items, ac.sendBatch(ctx, b, pending))
+		})
+	}
+}
+
+// parseDestination returns a batch for the destination URL, with the notifier
+// for its delivery type.
+func (ac *AlertChecker) parseDestination(alertURL string) (*batch, error) {
+	u, err := url.Parse(alertURL)
+	if err != nil {
+		// The error includes the URL, which may contain secrets.
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return nil, fmt.Errorf("unable to parse alert destination URL: %w", err)
+	}
+
+	// Accept type+http:// to allow specifing the kind of service.
+	// Without + (e.g. http:// or https://) default to "am" (i.e.
+	// "alertmanager").
+	deliverType := defaultDeliverType
+	extraScheme := strings.SplitN(u.Scheme, "+", 2)
+	if len(extraScheme) == 2 {
+		deliverType = extraScheme[0]
+		u.Scheme = extraScheme[1]
+	}
+
+	destination := logging.RedactURL(u)
+	notifier, ok := ac.notifiers[deliverType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown alert delivery type %v (in %q)", deliverType, destination)
+	}
+	return &batch{
+		destination: destination,
+		deliverType: deliverType,
+		url:         u,
+		notifier:    notifier,
+	}, nil
+}
+
+// sendBatch sends a batch of alerts to its destination.
+func (ac *AlertChecker) sendBatch(ctx context.Context, b *batch, pending []*outgoing) error {
+	alerts := make([]alertmanager.Alert, 0, len(b.items))
+	var groupLabels map[string]string
+	var links []oteltrace.Link
+	for _, i := range b.items {
+		o := pending[i]
+		alerts = append(alerts, o.alert)
+		groupLabels = commonLabels(groupLabels, o.groupLabels)
+		if sc := oteltrace.SpanContextFromContext(o.ctx); sc.IsValid() {
+			links = append(links, oteltrace.Link{SpanContext: sc})
+		}
+	}
+	// A single alert's logs and span belong with it, otherwise the span links
+	// to each of the alerts.
+	if len(b.items) == 1 {
+		ctx = pending[b.items[0]].ctx
+		links = nil
+	}
+
+	ctx = logging.NewContext(ctx,
+		slog.String(logging.KeyDestination, b.destination),
+		slog.String(logging.KeyStatus, b.status),
+		slog.String("type", b.deliverType))
+	ctx, span := ac.tracer.Start(ctx, "alertchecker.deliver",
+		oteltrace.WithLinks(links...),
+		oteltrace.WithAttributes(
+			deliveryTypeAttribute.String(b.deliverType),
+			destinationAttribute.String(b.destination),
+			batchSizeAttribute.Int(len(alerts))))
+	slog.InfoContext(ctx, "Sending notification", slog.Int("alerts", len(alerts)))
+
+	start := time.Now()
+	err := b.notifier.Notify(ctx, &Notification{
+		URL:         b.url,
+		Receiver:    b.receiver,
+		Status:      b.status,
+		GroupLabels: groupLabels,
+		Alerts:      alerts,
+	})
+	endSpan(span, err)
+	ac.metrics.recordDelivery(b.deliverType, b.destination, time.Since(start), err)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error sending notification", slog.Int("alerts", len(alerts)), deliveryErrorAttr(err))
+	}
+	return err
+}
+
+// commonLabels returns the labels in both a and b with the same value, if a is
+// nil b is returned.
+func commonLabels(a, b map[string]string) map[string]string {
+	if a == nil {
+		return b
+	}
+	common := map[string]string{}
+	for k, v := range a {
+		if bv, ok := b[k]; ok && bv == v {
+			common[k] = v
+		}
+	}
+	return common
+}
+
+// post sends a JSON body to the URL.
+func post(ctx context.Context, client *http.Client, u string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
 	}
-	return lastErr
+	req.Header.Set("Content-Type", "application/json")
+	return client.Do(req)
 }
 
 // alertBody is the body sent JSON encoded in webhook invocations, it aims to be compatible with
@@ -92,36 +259,50 @@ type alertBody struct {
 	Alerts            []alertmanager.Alert `json:"alerts"`
 }
 
-// makeAlertBody creates an alertBody
-func makeAlertBody(receiver string, resolved bool, groupLabels map[string]string, alerts []alertmanager.Alert) alertBody {
-	status := "firing"
-	if resolved {
-		status = "resolved"
-	}
+// makeAlertBody creates an alertBody, status is one of "firing", "resolved" or
+// "expired".
+func makeAlertBody(receiver string, status string, groupLabels map[string]string, alerts []alertmanager.Alert) alertBody {
 	return alertBody{
 		Version:           "4",
 		Status:            status,
 		Receiver:          receiver,
 		GroupLabels:       groupLabels,
-		CommonLabels:      alerts[0].Labels,
-		CommonAnnotations: alerts[0].Annotations,
+		CommonLabels:      common(alerts, func(a alertmanager.Alert) map[string]string { return a.Labels }),
+		CommonAnnotations: common(alerts, func(a alertmanager.Alert) map[string]string { return a.Annotations }),
 		Alerts:            alerts,
 	}
 }
 
-// sendWebhook sends a notification to an alertmanager webhook compatible endpoint.
-func sendWebhook(ctx context.Context, sendURL *url.URL, receiver string, resolved bool, groupLabels map[string]string, alerts []alertmanager.Alert) error {
+// common returns the labels or annotations (as returned by get) common to all
+// the alerts.
+func common(alerts []alertmanager.Alert, get func(alertmanager.Alert) map[string]string) map[string]string {
+	var c map[string]string
+	for _, a := range alerts {
+		c = commonLabels(c, get(a))
+	}
+	return c
+}
+
+// webhookNotifier sends notifications to an alertmanager webhook compatible
+// endpoint.
+type webhookNotifier struct {
+	client *http.Client
+}
+
+func (webhookNotifier) Capabilities() Capabilities {
+	return Capabilities{SupportsResolve: true, Batch: true}
+}
+
+func (wn webhookNotifier) Notify(ctx context.Context, n *Notification) error {
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
 	defer cancel()
 
-	body := makeAlertBody(receiver, resolved, groupLabels, alerts)
+	body := makeAlertBody(n.Receiver, n.Status, n.GroupLabels, n.Alerts)
 	j, err := json.Marshal(body)
 	if err != nil {
 		return err
 	}
-	u := sendURL.String()
-	log.Printf("Sending %s to %v", body.Status, u)
-	resp, err := http.Post(u, "application/json", bytes.NewBuffer(j))
+	resp, err := post(ctx, wn.client, n.URL.String(), j)
 	if err != nil {
 		return err
 	}
@@ -132,31 +313,41 @@ func sendWebhook(ctx context.Context, sendURL *url.URL, receiver string, resolve
 	return nil
 }
 
-// sendSlack sends a notification to a slack endpoint.
-func sendSlack(ctx context.Context, sendURL *url.URL, receiver string, resolved bool, groupLabels map[string]string, alerts []alertmanager.Alert) error {
+// slackNotifier sends notifications to a slack endpoint, formatted with
+// template.
+type slackNotifier struct {
+	template *template.Template
+	client   *http.Client
+}
+
+func (sn *slackNotifier) Capabilities() Capabilities {
+	// Avoid repeating slack notifications frequently, this is better than a
+	// noisy alert, otherwise we're going to end up duplicating all of
+	// alertmanager's logic here...
+	return Capabilities{SupportsResolve: true, MinRepeatInterval: slackSendInterval}
+}
+
+func (sn *slackNotifier) Notify(ctx context.Context, n *Notification) error {
 	ctx, cancel := context.WithTimeout(ctx, 1*time.Minute)
 	defer cancel()
 
-	body := makeAlertBody(receiver, resolved, groupLabels, alerts)
+	body := makeAlertBody(n.Receiver, n.Status, n.GroupLabels, n.Alerts)
 	// Default text used if templating fails
-	text := fmt.Sprintf("%v: %v, %v.\n%#v\n(templating problem)", body.Receiver, body.Status, groupLabels, alerts[0])
+	text := fmt.Sprintf("%v: %v, %v.\n%#v\n(templating problem)", body.Receiver, body.Status, n.GroupLabels, n.Alerts[0])
 
-	tmpl, err := template.New("slack").Parse(*flagSlackTemplate)
-	if err != nil {
-		log.Printf("Slack template.New: %v", err)
+	var buf bytes.Buffer
+	if err := sn.template.Execute(&buf, body); err != nil {
+		slog.WarnContext(ctx, "Slack tmpl.Execute failed", logging.Err(err))
 	} else {
-		var buf bytes.Buffer
-		err := tmpl.Execute(&buf, body)
-		if err != nil {
-			log.Printf("Slack tmpl.Execute: %v", err)
-		} else {
-			text = buf.String()
-		}
+		text = buf.String()
 	}
 
 	emoji := "exclamation"
-	if resolved {
+	switch n.Status {
+	case "resolved":
 		emoji = "grey_exclamation"
+	case "expired":
+		emoji = "heavy_multiplication_x"
 	}
 	j, err := json.Marshal(map[string]string{
 		"username":   body.Receiver,
@@ -166,9 +357,7 @@ func sendSlack(ctx context.Context, sendURL *url.URL, receiver string, resolved
 	if err != nil {
 		return err
 	}
-	u := sendURL.String()
-	log.Printf("Sending %s to %v", body.Status, u)
-	resp, err := http.Post(u, "application/json", bytes.NewBuffer(j))
+	resp, err := post(ctx, sn.client, n.URL.String(), j)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,150 @@
+package alertchecker
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+// apiVersion is the version of the /api/v1/instances format, it is increased
+// for changes which aren't backwards compatible.
+const apiVersion = 1
+
+// Instances is the response to /api/v1/instances.
+type Instances struct {
+	Version   int                 `json:"version"`
+	Monitored map[string]Instance `json:"monitored"`
+	Expired   map[string]Instance `json:"expired"`
+}
+
+// Instance is an instance as served on /api/v1/instances. It doesn't include
+// the annotations of the heartbeat, which may contain secrets, and its
+// destinations are redacted.
+type Instance struct {
+	Key          string            `json:"key"`
+	AlertName    string            `json:"alertName"`
+	Identifiers  map[string]string `json:"identifiers"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+	Receiver     string            `json:"receiver,omitempty"`
+	Destinations []string          `json:"destinations"`
+
+	FirstSeen     time.Time `json:"firstSeen"`
+	LastHeartbeat time.Time `json:"lastHeartbeat"`
+	Heartbeats    int       `json:"heartbeats"`
+	Armed         bool      `json:"armed"`
+	Activation    string    `json:"activation"`
+	ActivateAt    time.Time `json:"activateAt"`
+	ActivatedAt   time.Time `json:"activatedAt"`
+	ResolvedAt    time.Time `json:"resolvedAt"`
+	ExpiredAt     time.Time `json:"expiredAt"`
+	LastSent      time.Time `json:"lastSent"`
+
+	Firing        bool   `json:"firing"`
+	Suppressed    bool   `json:"suppressed"`
+	InhibitedBy   string `json:"inhibitedBy,omitempty"`
+	Flapping      bool   `json:"flapping"`
+	OutOfSchedule bool   `json:"outOfSchedule"`
+
+	Replicas map[string]time.Time `json:"replicas,omitempty"`
+	Quorum   int                  `json:"quorum,omitempty"`
+	Degraded bool                 `json:"degraded"`
+
+	LastError         string `json:"lastError,omitempty"`
+	DegradedLastError string `json:"degradedLastError,omitempty"`
+	DeliveryErrors    int    `json:"deliveryErrors"`
+}
+
+// apiInstance returns the API representation of an instance. Must be called
+// with the lock held.
+func apiInstance(instance *instanceDetails, now time.Time) Instance {
+	i := Instance{
+		Key:               instance.Key,
+		AlertName:         instance.AlertName,
+		Identifiers:       instance.Identifiers,
+		Receiver:          instance.Receiver,
+		Destinations:      []string{},
+		FirstSeen:         instance.FirstSeen,
+		LastHeartbeat:     instance.LastHeartbeat,
+		Heartbeats:        instance.Heartbeats,
+		Armed:             instance.Armed,
+		Activation:        instance.Activation.String(),
+		ActivateAt:        instance.ActivateAt,
+		ActivatedAt:       instance.ActivatedAt,
+		ResolvedAt:        instance.ResolvedAt,
+		ExpiredAt:         instance.ExpiredAt,
+		LastSent:          instance.LastSent,
+		Firing:            instance.firing(now),
+		Suppressed:        instance.Suppressed,
+		InhibitedBy:       instance.InhibitedBy,
+		Flapping:          instance.Flapping,
+		OutOfSchedule:     instance.OutOfSchedule,
+		Replicas:          instance.Replicas,
+		Quorum:            instance.Quorum,
+		Degraded:          instance.Degraded(),
+		LastError:         instance.LastError,
+		DegradedLastError: instance.DegradedLastError,
+		DeliveryErrors:    instance.DeliveryErrors,
+	}
+	if instance.LearnedActivation != 0 {
+		i.Activation = instance.LearnedActivation.String()
+	}
+	if instance.LastAlert != nil {
+		i.Labels = instance.LastAlert.Labels
+		i.GeneratorURL = instance.LastAlert.GeneratorURL
+	}
+	for _, am := range instance.AlertManagers {
+		i.Destinations = append(i.Destinations, redactDestination(am))
+	}
+	return i
+}
+
+// redactDestination returns a destination (from msd_alertmanagers) redacted
+// by logging.RedactURL, keeping the delivery type.
+func redactDestination(destination string) string {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	deliverType := defaultDeliverType
+	if extraScheme := strings.SplitN(u.Scheme, "+", 2); len(extraScheme) == 2 {
+		deliverType = extraScheme[0]
+		u.Scheme = extraScheme[1]
+	}
+	clean := logging.RedactURL(u)
+	if deliverType != defaultDeliverType {
+		clean = deliverType + "+" + clean
+	}
+	return clean
+}
+
+// Responds to /api/v1/instances with the monitored and expired instances as
+// JSON.
+func (ac *AlertChecker) instances(w http.ResponseWriter, req *http.Request) {
+	ac.RLock()
+	defer ac.RUnlock()
+
+	now := ac.now()
+	resp := Instances{
+		Version:   apiVersion,
+		Monitored: map[string]Instance{},
+		Expired:   map[string]Instance{},
+	}
+	for key, instance := range ac.monitored {
+		resp.Monitored[key] = apiInstance(instance, now)
+	}
+	for key, instance := range ac.expired {
+		resp.Expired[key] = apiInstance(instance, now)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error serving instances", logging.Err(err))
+	}
+}
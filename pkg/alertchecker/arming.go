@@ -0,0 +1,40 @@
+package alertchecker
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// parseArmAfter parses msd_arm_after, which is a number of heartbeats, a
+// duration, or both (space separated, whichever is reached first arms the
+// instance).
+func parseArmAfter(s string) (count int, d time.Duration, err error) {
+	for _, item := range splitAnnotation(s) {
+		if n, err := strconv.Atoi(item); err == nil {
+			count = n
+			continue
+		}
+		d, err = time.ParseDuration(item)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q is not a number of heartbeats or a duration", item)
+		}
+	}
+	return count, d, nil
+}
+
+// checkArmed updates whether the instance is armed, i.e. has been seen enough
+// to be allowed to alert. Called on each heartbeat.
+func (i *instanceDetails) checkArmed(now time.Time) {
+	if i.Armed {
+		return
+	}
+	switch {
+	case i.ArmAfterCount <= 0 && i.ArmAfterDuration <= 0:
+		i.Armed = true
+	case i.ArmAfterCount > 0 && i.Heartbeats >= i.ArmAfterCount:
+		i.Armed = true
+	case i.ArmAfterDuration > 0 && now.Sub(i.FirstSeen) >= i.ArmAfterDuration:
+		i.Armed = true
+	}
+}
@@ -5,18 +5,24 @@ package alertchecker
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"sort"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/trace"
 
+	"github.com/G-Research/prommsd/pkg/alerthook"
 	"github.com/G-Research/prommsd/pkg/alertmanager"
+	"github.com/G-Research/prommsd/pkg/logging"
 )
 
 const (
@@ -28,12 +34,14 @@ const (
 
 	annotationPrefix   = "msda_"
 	defaultIdentifiers = "job namespace cluster"
+
+	// neverExpire is used for ExpireAfter when msd_expire is "never".
+	neverExpire time.Duration = -1
 )
 
-var instanceMetric = prometheus.NewGauge(prometheus.GaugeOpts{
-	Namespace: "prommsd",
-	Subsystem: "alertchecker",
-	Name:      "monitored_instances"})
+// defaultCheckInterval is the longest time between checks, instances are
+// checked when they are due but summary alerts are checked on this interval.
+const defaultCheckInterval = 5 * time.Second
 
 // AlertChecker implements the alerthook.AlertHandler interface, it receives
 // alerts and applies this package's business logic to them.
@@ -41,33 +49,166 @@ type AlertChecker struct {
 	// Lock when accessing monitored. Needed because status runs in a different
 	// goroutine.
 	sync.RWMutex
-	monitored   map[string]*instanceDetails
-	handleChan  chan handleAlert
-	healthChan  chan interface{}
-	externalURL string
+	monitored map[string]*instanceDetails
+	// When each monitored instance next needs checking.
+	deadlines *deadlineQueue
+	// Recent activations, for mass outage detection.
+	activations []activation
+	// Instances that have expired, kept for display on the status page until
+	// ExpiredRetention has passed.
+	expired map[string]*instanceDetails
+	// When instances were deleted (by /modify or aging out unarmed), so peers
+	// don't add them back, kept until ExpiredRetention has passed.
+	deleted map[string]time.Time
+	// Current mass outage summary alert, nil if there isn't one.
+	outage *summaryAlert
+	// Alert for not receiving any heartbeats at all, nil if there isn't one.
+	isolation *summaryAlert
+	// When the last heartbeat was received from any instance.
+	lastReceived time.Time
+	handleChan   chan handleAlert
+	healthChan   chan interface{}
+	externalURL  string
+
+	config        Config
+	schedules     map[string]*schedule
+	scheduleCache sync.Map
+	notifiers     map[string]Notifier
+	metrics       *metrics
+	amMetrics     *alertmanager.Metrics
+	checkInterval time.Duration
+	// Tracing and outgoing requests, see WithTracerProvider and
+	// WithHTTPClient.
+	tracerProvider oteltrace.TracerProvider
+	tracer         oteltrace.Tracer
+	httpClient     *http.Client
+
+	// deliveries sends notifications in the background, sending tracks the
+	// alerts queued or being sent so they aren't repeated meanwhile.
+	deliveries *deliveryQueue
+	sending    map[sendingKey]bool
+
+	// stopChan is closed by Shutdown to stop Run, which closes done once it
+	// has finished any check (and so deliveries) in progress.
+	running       bool
+	notReady      map[string]bool
+	stopOnce      sync.Once
+	stopChan      chan struct{}
+	done          chan struct{}
+	shutdownHooks []ShutdownHook
+	// Restored instances don't activate before warmUpUntil.
+	warmUpUntil time.Time
+	// The replicas (see ha.go), sender is whether this one was last sending.
+	peers  []*peer
+	sender bool
+
+	// Checker loop health, for Healthy and Status.
+	healthTimeout     time.Duration
+	lastCheck         time.Time
+	lastCheckDuration time.Duration
+	loopLag           time.Duration
 	// To allow testing with fake time
 	now func() time.Time
 }
 
-// New returns a new AlertChecker. It is only expected there is one instance of
-// this per binary as it runs a goroutine in the background.
-func New(registerer prometheus.Registerer, externalURL string) *AlertChecker {
-	ac := makeAlertChecker(externalURL)
-	go ac.checker()
-	registerer.MustRegister(instanceMetric)
-	http.HandleFunc("/", ac.status)
-	http.HandleFunc("/modify", ac.modify)
-	return ac
-}
+// New returns a new AlertChecker. Run must be called for it to check
+// instances and handle heartbeats, its status pages are served by Handler.
+func New(opts ...Option) (*AlertChecker, error) {
+	o := options{config: DefaultConfig()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.config.DeliveryWorkers < 1 || o.config.DestinationConcurrency < 1 || o.config.IngestQueueSize < 1 {
+		return nil, errors.New("DeliveryWorkers, DestinationConcurrency and IngestQueueSize must be at least 1")
+	}
+
+	ac := &AlertChecker{
+		monitored:     make(map[string]*instanceDetails),
+		deadlines:     newDeadlineQueue(),
+		expired:       make(map[string]*instanceDetails),
+		deleted:       make(map[string]time.Time),
+		handleChan:    make(chan handleAlert, o.config.IngestQueueSize),
+		healthChan:    make(chan interface{}),
+		externalURL:   o.externalURL,
+		config:        o.config,
+		schedules:     map[string]*schedule{},
+		metrics:       newMetrics(),
+		amMetrics:     alertmanager.NewMetrics(),
+		checkInterval: defaultCheckInterval,
+		stopChan:      make(chan struct{}),
+		done:          make(chan struct{}),
+		sending:       map[sendingKey]bool{},
+		notReady:      map[string]bool{},
+		healthTimeout: defaultHealthTimeout,
+		now:           time.Now,
+	}
+	if o.config.RecoverFrom != "" {
+		// Until Recover returns.
+		ac.notReady[recoveringReason] = true
+	}
+	if o.config.Peers != "" {
+		if o.externalURL == "" || o.config.PeerInterval <= 0 || o.config.PeerToken == "" {
+			return nil, errors.New("Peers requires an external URL, to identify this replica, a PeerInterval and a PeerToken")
+		}
+		ac.peers = newPeers(o.externalURL, strings.Fields(o.config.Peers), ac.now())
+	}
+	ac.deliveries = newDeliveryQueue(o.config.DeliveryWorkers, o.config.DestinationConcurrency, ac.metrics)
+	ac.metrics.ingestCapacity.Set(float64(o.config.IngestQueueSize))
+	ac.setupTracing(&o)
+
+	for name, spec := range o.config.Schedules {
+		s, err := parseSchedule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", name, err)
+		}
+		ac.schedules[name] = s
+	}
+	tmpl, err := template.New("slack").Parse(o.config.SlackTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("slack template: %w", err)
+	}
+	ac.notifiers = map[string]Notifier{
+		defaultDeliverType: &alertmanagerNotifier{ac.alertmanagerClient},
+		"webhook":          webhookNotifier{ac.httpClient},
+		"slack":            &slackNotifier{tmpl, ac.httpClient},
+	}
+	for deliverType, n := range o.notifiers {
+		ac.notifiers[deliverType] = n
+	}
 
-func makeAlertChecker(externalURL string) *AlertChecker {
-	return &AlertChecker{
-		monitored:   make(map[string]*instanceDetails),
-		handleChan:  make(chan handleAlert),
-		healthChan:  make(chan interface{}),
-		externalURL: externalURL,
-		now:         time.Now,
+	if o.registerer != nil {
+		ac.metrics.register(o.registerer)
+		o.registerer.MustRegister(ac.amMetrics)
+		o.registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "prommsd",
+			Subsystem: "delivery",
+			Name:      "queue_oldest_seconds",
+			Help:      "Time the oldest notification waiting to be sent has been queued"},
+			func() float64 { return ac.deliveries.oldest().Seconds() }))
+		o.registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "prommsd",
+			Subsystem: "alertchecker",
+			Name:      "heartbeat_queue_length",
+			Help:      "Received heartbeats waiting to be processed"},
+			func() float64 { return float64(len(ac.handleChan)) }))
+		if o.config.InstanceMetricsLimit > 0 {
+			o.registerer.MustRegister(&instanceCollector{ac})
+		}
 	}
+	return ac, nil
+}
+
+// Handler returns a handler for the status page ("/"), "/modify",
+// "/api/v1/instances", "/-/status" and "/-/state" (for peers, only served
+// with Peers and requiring PeerToken).
+func (ac *AlertChecker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", ac.status)
+	mux.HandleFunc("/modify", ac.modify)
+	mux.HandleFunc("/api/v1/instances", ac.instances)
+	mux.HandleFunc("/-/status", ac.statusJSON)
+	mux.HandleFunc("/-/state", ac.stateHandler)
+	return mux
 }
 
 type handleAlert struct {
@@ -75,21 +216,86 @@ type handleAlert struct {
 	instance *instanceDetails
 }
 
+// instanceDetails is the state of an instance. It is also the format of the
+// internal state (see state), so fields are tagged to keep it stable; fields
+// tagged with the same name as before (case-insensitively) still restore from
+// state written by older versions.
 type instanceDetails struct {
-	ActivateAt, LastSent    time.Time
-	ActivatedAt, ResolvedAt time.Time
-	AlertName               string
-	Receiver                string
-	AlertManagers           []string
-	OverrideLabels          []string
-	LastAlert               *alertmanager.Alert
-	LastError               string
+	ActivateAt     time.Time           `json:"activateAt"`
+	LastSent       time.Time           `json:"lastSent"`
+	ActivatedAt    time.Time           `json:"activatedAt"`
+	ResolvedAt     time.Time           `json:"resolvedAt"`
+	ExpiredAt      time.Time           `json:"expiredAt"`
+	FirstSeen      time.Time           `json:"firstSeen"`
+	Activation     time.Duration       `json:"activation"`
+	ExpireAfter    time.Duration       `json:"expireAfter"`
+	AlertName      string              `json:"alertName"`
+	Receiver       string              `json:"receiver"`
+	AlertManagers  []string            `json:"alertManagers"`
+	OverrideLabels []string            `json:"overrideLabels"`
+	LastAlert      *alertmanager.Alert `json:"lastAlert"`
+	LastError      string              `json:"lastError"`
+	// Suppressed is set while a summary alert (mass outage or isolation)
+	// covers this instance.
+	Suppressed bool `json:"suppressed"`
+	// ParentKey is the key of the instance that inhibits this one (from
+	// msd_inhibited_by), InhibitedBy is set to it while the parent is firing.
+	ParentKey   string `json:"parentKey"`
+	InhibitedBy string `json:"inhibitedBy"`
+	// Replica tracking, for msd_replica_label. Replica is the replica the
+	// heartbeat was from, Replicas maps all known replicas to when they will be
+	// considered missing.
+	ReplicaLabel         string               `json:"replicaLabel"`
+	Replica              string               `json:"replica"`
+	Replicas             map[string]time.Time `json:"replicas"`
+	Quorum               int                  `json:"quorum"`
+	QuorumOverrideLabels []string             `json:"quorumOverrideLabels"`
+	// Set while the number of replicas is below the quorum (but not all
+	// replicas are missing).
+	DegradedAt         time.Time `json:"degradedAt"`
+	DegradedResolvedAt time.Time `json:"degradedResolvedAt"`
+	DegradedLastSent   time.Time `json:"degradedLastSent"`
+	DegradedLastError  string    `json:"degradedLastError"`
+	// Adaptive activation, for msd_activation: adaptive. Intervals are the
+	// recent times between heartbeats, which are used to learn the activation
+	// (falling back to Activation until there are enough).
+	Adaptive          bool            `json:"adaptive"`
+	ActivationMin     time.Duration   `json:"activationMin"`
+	ActivationMax     time.Duration   `json:"activationMax"`
+	LastHeartbeat     time.Time       `json:"lastHeartbeat"`
+	Intervals         []time.Duration `json:"intervals,omitempty"`
+	LearnedActivation time.Duration   `json:"learnedActivation"`
+	// Flap detection: recent firing/resolved transitions, while Flapping a
+	// resolve is held back and the instance kept firing (HeldFiring).
+	Transitions []time.Time `json:"transitions"`
+	Flapping    bool        `json:"flapping"`
+	HeldFiring  bool        `json:"heldFiring"`
+	// Arming, from msd_arm_after: the instance can only alert once Armed.
+	ArmAfterCount    int           `json:"armAfterCount"`
+	ArmAfterDuration time.Duration `json:"armAfterDuration"`
+	Heartbeats       int           `json:"heartbeats"`
+	Armed            bool          `json:"armed"`
+	// Schedule, from msd_schedule, outside of which the instance doesn't
+	// alert.
+	Schedule      *schedule `json:"-"`
+	OutOfSchedule bool      `json:"outOfSchedule"`
+	// Time from the heartbeat being evaluated to being received, if known from
+	// msd_timestamp.
+	DeliveryLag time.Duration `json:"deliveryLag"`
+	Key         string        `json:"key"`
+	// HeartbeatSpan is the span of the request the last heartbeat was
+	// received in, deliveries link back to it.
+	HeartbeatSpan oteltrace.SpanContext `json:"-"`
+	// Identifiers are the identifier labels and their values.
+	Identifiers    map[string]string `json:"identifiers"`
+	DeliveryErrors int               `json:"deliveryErrors"`
 }
 
 // HandleAlert receives a single alert from the alerts sent to an alertmanager
-// webhook. It parses the annotations as configuration and then sends a
-// "handleAlert" struct to handleChan, which the checker goroutine receives and
-// calls updateInstance.
+// webhook. It parses the annotations as configuration and then queues a
+// "handleAlert" struct on handleChan, which the checker goroutine receives and
+// calls updateInstance. It doesn't wait for the checker, if the queue is full
+// it returns alerthook.ErrOverloaded.
 func (ac *AlertChecker) HandleAlert(ctx context.Context, alert *alertmanager.Alert) error {
 	if alert.Status == "resolved" {
 		// Ignore resolved because we only care about our activation timeout; we
@@ -98,14 +304,59 @@ func (ac *AlertChecker) HandleAlert(ctx context.Context, alert *alertmanager.Ale
 		return nil
 	}
 
-	// Turn specified identifiers into key.
-	identifierLabels := alert.GetAnnotationDefault("msd_identifiers", defaultIdentifiers)
-	var ids []string
-	for _, id := range splitAnnotation(identifierLabels) {
-		ids = append(ids, id+"="+fmt.Sprintf("%q", alert.GetLabelDefault(id, "")))
+	key := heartbeatKey(alert)
+	ctx = logging.NewContext(ctx, slog.String(logging.KeyInstance, key))
+
+	lag, lagOK, err := ac.checkFreshness(ctx, ac.now(), alert)
+	if err != nil {
+		// Treat as missing, so the instance will activate if this continues.
+		slog.WarnContext(ctx, "Ignoring stale heartbeat", logging.Err(err))
+		return nil
+	}
+	if lagOK {
+		ac.metrics.deliveryLag.Observe(lag.Seconds())
+	}
+
+	instance := ac.newInstance(ctx, key, alert)
+	instance.DeliveryLag = lag
+
+	select {
+	case <-ac.stopChan:
+		return errShuttingDown
+	case <-ac.done:
+		return errShuttingDown
+	default:
+	}
+	select {
+	case ac.handleChan <- handleAlert{key, instance}:
+	default:
+		ac.metrics.ingestRejected.Inc()
+		slog.WarnContext(ctx, "Heartbeat queue full, rejecting heartbeat")
+		return fmt.Errorf("heartbeat queue full: %w", alerthook.ErrOverloaded)
+	}
+
+	return nil
+}
+
+// heartbeatKey returns the key of the instance a heartbeat is for, from its
+// msd_identifiers.
+func heartbeatKey(alert *alertmanager.Alert) string {
+	return makeKey(alert, splitAnnotation(alert.GetAnnotationDefault("msd_identifiers", defaultIdentifiers)))
+}
+
+// newInstance parses the annotations of a heartbeat into a new instance, as if
+// the heartbeat had just been received.
+func (ac *AlertChecker) newInstance(ctx context.Context, key string, alert *alertmanager.Alert) *instanceDetails {
+	identifiers := map[string]string{}
+	for _, id := range splitAnnotation(alert.GetAnnotationDefault("msd_identifiers", defaultIdentifiers)) {
+		identifiers[id] = alert.GetLabelDefault(id, "")
+	}
+
+	// The parent instance is the one identified by just the inhibiting labels.
+	var parentKey string
+	if inhibitedBy := splitAnnotation(alert.GetAnnotationDefault("msd_inhibited_by", ac.config.InhibitedBy)); len(inhibitedBy) > 0 {
+		parentKey = makeKey(alert, inhibitedBy)
 	}
-	sort.Strings(ids)
-	key := strings.Join(ids, " ")
 
 	alertName := alert.GetAnnotationDefault("msd_alertname", "NoAlertConnectivity")
 	overrideLabels := alert.GetAnnotationDefault("msd_override_labels", "severity=critical")
@@ -113,51 +364,152 @@ func (ac *AlertChecker) HandleAlert(ctx context.Context, alert *alertmanager.Ale
 	// specify multiple URLs for reliability.
 	alertManagers := alert.GetAnnotationDefault("msd_alertmanagers", alert.Parent.ExternalURL)
 
-	activationDuration, err := time.ParseDuration(alert.GetAnnotationDefault("msd_activation", "10m"))
+	activation := strings.TrimSpace(alert.GetAnnotationDefault("msd_activation", "10m"))
+	adaptive := strings.HasPrefix(activation, "adaptive")
+	if adaptive {
+		// "adaptive" or "adaptive 10m", with the duration used until enough
+		// heartbeats have been seen.
+		activation = strings.TrimSpace(strings.TrimPrefix(activation, "adaptive"))
+		if activation == "" {
+			activation = defaultActivation.String()
+		}
+	}
+	activationDuration, err := time.ParseDuration(activation)
 	if err != nil {
-		log.Printf("Failed to parse msd_activation: %v, default to %d", err, defaultActivation)
+		slog.WarnContext(ctx, "Failed to parse msd_activation, using default", logging.Err(err), slog.Duration("default", defaultActivation))
 		activationDuration = defaultActivation
 	}
 
+	expireAfter, err := parseExpire(alert.GetAnnotationDefault("msd_expire", expireTime.String()))
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to parse msd_expire, using default", logging.Err(err), slog.Duration("default", expireTime))
+		expireAfter = expireTime
+	}
+
+	armAfterCount, armAfterDuration, err := parseArmAfter(alert.GetAnnotationDefault("msd_arm_after", ac.config.ArmAfter))
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to parse msd_arm_after, arming immediately", logging.Err(err))
+	}
+
+	var sched *schedule
+	if spec, ok := alert.GetAnnotation("msd_schedule"); ok {
+		sched, err = ac.getSchedule(spec)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to parse msd_schedule, alerting at all times", logging.Err(err))
+		}
+	}
+
 	instance := instanceDetails{
-		ActivateAt:     ac.now().Add(activationDuration),
-		AlertManagers:  splitAnnotation(alertManagers),
-		AlertName:      alertName,
-		Receiver:       alert.Parent.Receiver,
-		OverrideLabels: splitAnnotation(overrideLabels),
+		ActivateAt:       ac.now().Add(activationDuration),
+		FirstSeen:        ac.now(),
+		LastHeartbeat:    ac.now(),
+		Activation:       activationDuration,
+		ExpireAfter:      expireAfter,
+		ParentKey:        parentKey,
+		ArmAfterCount:    armAfterCount,
+		ArmAfterDuration: armAfterDuration,
+		Heartbeats:       1,
+		Schedule:         sched,
+		Identifiers:      identifiers,
+		Key:              key,
+		HeartbeatSpan:    oteltrace.SpanContextFromContext(ctx),
+		AlertManagers:    splitAnnotation(alertManagers),
+		AlertName:        alertName,
+		Receiver:         alert.Parent.Receiver,
+		OverrideLabels:   splitAnnotation(overrideLabels),
 		// n.b.: Holds a ref to parent and therefore other alerts which we
 		// potentially don't need (but probably not very many), consider just
 		// copying the data we want here instead.
 		LastAlert: alert,
 	}
-	ac.handleChan <- handleAlert{key, &instance}
-
-	return nil
+	if adaptive {
+		parseAdaptive(alert, &instance)
+	}
+	if replicaLabel, ok := alert.GetAnnotation("msd_replica_label"); ok {
+		parseReplicas(alert, strings.TrimSpace(replicaLabel), &instance)
+	}
+	return &instance
 }
 
-func (ac *AlertChecker) Healthy() bool {
-	// We rely on this chan being blocking, if the checker goroutine doesn't read
-	// from it the request will simply timeout for the user.
-	ac.healthChan <- nil
-	return true
-}
+// Run checks the monitored instances and handles heartbeats until ctx is done
+// or Shutdown is called. It returns once any deliveries queued or in progress
+// have completed.
+func (ac *AlertChecker) Run(ctx context.Context) error {
+	ac.Lock()
+	if ac.running {
+		ac.Unlock()
+		return errors.New("already running")
+	}
+	ac.running = true
+	ac.startWarmUp(ac.now())
+	ac.Unlock()
+	defer close(ac.done)
+	ac.deliveries.start()
+	defer ac.deliveries.stop()
+	if len(ac.peers) > 0 {
+		go ac.syncPeers(ctx)
+	}
 
-func (ac *AlertChecker) checker() {
 	events := trace.NewEventLog("alertchecker.checker", "")
-	tick := time.Tick(5 * time.Second)
+	defer events.Finish()
+	// Checks run when the earliest instance deadline is reached, and at least
+	// every checkInterval for the summary alerts.
+	wakeAt := ac.now().Add(ac.checkInterval)
+	timer := time.NewTimer(ac.checkInterval)
+	defer timer.Stop()
+	reset := func(at time.Time) {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		wakeAt = at
+		timer.Reset(at.Sub(ac.now()))
+	}
 
 	for {
 		select {
-		case <-tick:
-			ac.checkMonitored(events, ac.now())
+		case <-ctx.Done():
+			return nil
+		case <-ac.stopChan:
+			return nil
+		case <-timer.C:
+			now := ac.now()
+			start := time.Now()
+			ac.checkMonitored(events, now)
+			ac.Lock()
+			ac.lastCheck = now
+			ac.lastCheckDuration = time.Since(start)
+			ac.loopLag = now.Sub(wakeAt)
+			ac.Unlock()
+			reset(ac.nextWake(now))
 		case handle := <-ac.handleChan:
 			ac.updateInstance(handle.key, handle.instance)
+			if next := ac.nextWake(ac.now()); next.Before(wakeAt) {
+				reset(next)
+			}
 		case <-ac.healthChan:
 			// See comment in Healthy.
 		}
 	}
 }
 
+// nextWake returns when the next check should run, the earliest instance
+// deadline, the end of the warm-up or checkInterval after now.
+func (ac *AlertChecker) nextWake(now time.Time) time.Time {
+	ac.RLock()
+	defer ac.RUnlock()
+	wake := now.Add(ac.checkInterval)
+	if next, ok := ac.deadlines.next(); ok && next.Before(wake) {
+		wake = next
+	}
+	if ac.warmingUp(now) && ac.warmUpUntil.Before(wake) {
+		wake = ac.warmUpUntil
+	}
+	return wake
+}
+
 // updateInstance receives messages from HandleAlert. It should be fast as
 // operations here are on the single checking goroutine.
 func (ac *AlertChecker) updateInstance(key string, instance *instanceDetails) {
@@ -165,20 +517,47 @@ func (ac *AlertChecker) updateInstance(key string, instance *instanceDetails) {
 	defer ac.Unlock()
 	oldInstance, ok := ac.monitored[key]
 	ac.monitored[key] = instance
-	instanceMetric.Set(float64(len(ac.monitored)))
+	ac.lastReceived = ac.now()
+	delete(ac.expired, key)
+	delete(ac.deleted, key)
+	ac.metrics.instances.Set(float64(len(ac.monitored)))
 	if !ok {
-		log.Printf("New instance %v, will activate at %v and send to %v", key, instance.ActivateAt, instance.AlertManagers)
+		slog.Info("New instance", slog.String(logging.KeyInstance, key), slog.Time("activate_at", instance.ActivateAt), slog.Int("destinations", len(instance.AlertManagers)))
 	} else {
-		if oldInstance.LastSent.After(oldInstance.ActivateAt) {
-			instance.ResolvedAt = ac.now()
-			log.Printf("Alert resolved for instance %v", key)
+		instance.Transitions = oldInstance.Transitions
+		instance.Flapping = oldInstance.Flapping
+		// A firing alert still being sent counts as sent, otherwise the
+		// resolve would be lost once it is delivered.
+		sending := ac.sending[sendingKey{"alert", key}] && ac.now().After(oldInstance.ActivateAt)
+		if oldInstance.LastSent.After(oldInstance.ActivateAt) || sending || oldInstance.HeldFiring {
+			if oldInstance.Flapping {
+				instance.HeldFiring = true
+				instance.ResolvedAt = oldInstance.ResolvedAt
+				slog.Info("Instance is flapping, holding alert firing", slog.String(logging.KeyInstance, key))
+			} else {
+				instance.ResolvedAt = ac.now()
+				ac.recordTransition(instance, ac.now())
+				slog.Info("Alert resolved", slog.String(logging.KeyInstance, key))
+			}
 		} else {
 			instance.ResolvedAt = oldInstance.ResolvedAt
 		}
 		instance.ActivatedAt = oldInstance.ActivatedAt
+		instance.FirstSeen = oldInstance.FirstSeen
+		instance.Heartbeats = oldInstance.Heartbeats + 1
+		instance.Armed = oldInstance.Armed
 		instance.LastSent = oldInstance.LastSent
 		instance.LastError = oldInstance.LastError
+		instance.DeliveryErrors = oldInstance.DeliveryErrors
+	}
+	instance.checkArmed(ac.now())
+	ac.config.recordInterval(ac.now(), oldInstance, instance)
+	if instance.ReplicaLabel != "" {
+		mergeReplicas(ac.now(), oldInstance, instance)
 	}
+	// Anything the heartbeat means should be sent (e.g. resolved) is sent on
+	// the next check.
+	ac.deadlines.set(key, ac.nextCheck(instance, ac.now(), 0))
 }
 
 func (ac *AlertChecker) checkMonitored(events trace.EventLog, now time.Time) {
@@ -186,56 +565,232 @@ func (ac *AlertChecker) checkMonitored(events trace.EventLog, now time.Time) {
 	tr := trace.New("alertchecker.checkMonitored", "check")
 	defer tr.Finish()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+	ctx, span := ac.tracer.Start(context.Background(), "alertchecker.checkMonitored")
+	defer span.End()
 
 	toAlert := []*instanceDetails{}
+	toDegraded := []*instanceDetails{}
 	ac.Lock()
-	for key, instance := range ac.monitored {
-		active := now.After(instance.ActivateAt)
+	// Only instances with a deadline that has passed need looking at, each is
+	// rescheduled below unless removed.
+	due := ac.deadlines.popDue(now)
+	for _, key := range due {
+		instance, ok := ac.monitored[key]
+		if !ok {
+			continue
+		}
+		instance.checkSchedule(now)
+		if !instance.Armed && now.After(instance.ActivateAt) {
+			// Not seen enough to be trusted to alert, just forget about it.
+			slog.Info("Unarmed instance stopped sending heartbeats, removing", slog.String(logging.KeyInstance, key))
+			events.Printf("Aged out unarmed %v", key)
+			delete(ac.monitored, key)
+			ac.deleted[key] = instance.LastHeartbeat
+			ac.metrics.instances.Set(float64(len(ac.monitored)))
+			continue
+		}
+		if now.After(instance.ActivateAt) && instance.ActivateAt.After(instance.ActivatedAt) {
+			if !instance.HeldFiring {
+				ac.recordTransition(instance, now)
+			}
+			instance.ActivatedAt = now
+			ac.activations = append(ac.activations, activation{key, now})
+		}
+		ac.checkFlapping(key, instance, now)
+	}
+	ac.checkWarmUp(now)
+	isolated := ac.checkIsolation(now)
+	isolation := ac.isolation
+	sendIsolation := isolation != nil && now.After(isolation.LastSent.Add(sendInterval))
+	var suppressed map[string]bool
+	if !isolated {
+		suppressed = ac.checkMassOutage(now)
+	}
+	outage := ac.outage
+	sendOutage := !isolated && outage != nil && now.After(outage.LastSent.Add(sendInterval))
+	for _, key := range due {
+		instance, ok := ac.monitored[key]
+		if !ok {
+			continue
+		}
+		active := instance.firing(now)
 		sendResolved := now.Before(instance.ResolvedAt.Add(resolveRepeat))
-		if active && instance.ActivateAt.After(instance.LastSent) {
-			log.Printf("Alerting for %v", key)
+		instance.Suppressed = active && (isolated || suppressed[key])
+		instance.InhibitedBy = ""
+		if parent, ok := ac.monitored[instance.ParentKey]; ok && active && instance.ParentKey != key && parent.Armed && parent.firing(now) && !parent.OutOfSchedule {
+			instance.InhibitedBy = instance.ParentKey
+		}
+		if instance.Armed && instance.checkQuorum(now) && !instance.Suppressed && instance.InhibitedBy == "" && !ac.sending[sendingKey{"degraded", key}] {
+			toDegraded = append(toDegraded, instance)
+		}
+		if active && instance.ActivateAt.After(instance.LastSent) && !instance.Suppressed && instance.InhibitedBy == "" {
+			slog.Info("Alerting", slog.String(logging.KeyInstance, key))
 		}
 		if active || sendResolved {
-			if now.After(instance.LastSent.Add(sendInterval)) {
+			if expiresAt, ok := instance.expiresAt(); ok && now.After(expiresAt) && !isolated {
+				// Give up, but tell the destinations we have, rather than
+				// silently stopping.
+				slog.Warn("Instance expired, sending final notification", slog.String(logging.KeyInstance, key))
+				events.Printf("Expired %v", key)
+				instance.ExpiredAt = now
+				delete(ac.monitored, key)
+				ac.expired[key] = instance
+				ac.metrics.instances.Set(float64(len(ac.monitored)))
+				toAlert = append(toAlert, instance)
+			} else if instance.Suppressed {
+				events.Printf("Suppressed by summary alert: %v", key)
+			} else if instance.InhibitedBy != "" {
+				events.Printf("Inhibited by %v: %v", instance.InhibitedBy, key)
+			} else if ac.sending[sendingKey{"alert", key}] {
+				events.Printf("Previous alert still being sent: %v", key)
+			} else if now.After(instance.LastSent.Add(sendInterval)) {
 				events.Printf("Alerting (active=%v, resolved=%v): %v", active, sendResolved, key)
-				if active && instance.ActivateAt.After(instance.ActivatedAt) {
-					instance.ActivatedAt = now
-				}
 				toAlert = append(toAlert, instance)
 			}
-			if now.After(instance.ActivateAt.Add(expireTime)) {
-				delete(ac.monitored, key)
-				events.Printf("Expired %v", key)
-				instanceMetric.Set(float64(len(ac.monitored)))
-			}
+		}
+		if _, ok := ac.monitored[key]; ok {
+			ac.scheduleCheck(key, instance, now)
 		}
 	}
+	for key, instance := range ac.expired {
+		if now.After(instance.ExpiredAt.Add(ac.config.ExpiredRetention)) {
+			delete(ac.expired, key)
+		}
+	}
+	for key, deletedAt := range ac.deleted {
+		if now.After(deletedAt.Add(ac.config.ExpiredRetention)) {
+			delete(ac.deleted, key)
+		}
+	}
+	span.SetAttributes(
+		attribute.Int("prommsd.instances", len(ac.monitored)),
+		attribute.Int("prommsd.due", len(due)),
+		attribute.Int("prommsd.alerts", len(toAlert)))
+
+	if !ac.checkSender(now) {
+		// Another replica sends, its deliveries are replicated to us.
+		events.Printf("Standing by, not sending %d alerts", len(toAlert)+len(toDegraded))
+		toAlert, toDegraded = nil, nil
+		sendOutage, sendIsolation = false, false
+	}
+	var pending []*outgoing
+	for _, instance := range toDegraded {
+		pending = append(pending, ac.alertDegraded(ctx, now, instance))
+	}
+	for _, instance := range toAlert {
+		pending = append(pending, ac.alert(ctx, now, instance))
+	}
+	if sendOutage && !ac.sending[sendingKey{"summary", outage.AlertName}] {
+		pending = append(pending, ac.alertSummary(ctx, now, outage))
+	}
+	if sendIsolation && !ac.sending[sendingKey{"summary", isolation.AlertName}] {
+		pending = append(pending, ac.alertSummary(ctx, now, isolation))
+	}
 	ac.Unlock()
 
-	wg := sync.WaitGroup{}
-	for _, instance := range toAlert {
-		wg.Add(1)
-		// n.b.: Safe to access instance from this goroutine as there is one per
-		// instance and we only write to an existing instance here.
-		go ac.alert(&wg, ctx, now, instance)
+	// Deliveries continue after the check, in the background.
+	ac.deliver(context.WithoutCancel(ctx), pending)
+}
+
+// sendingKey identifies an alert being sent, kind is "alert", "degraded" or
+// "summary" and key the instance key (or summary alertname).
+type sendingKey struct {
+	kind, key string
+}
+
+// currentInstance returns the instance now stored for instance's key, as
+// updateInstance replaces the instance on each heartbeat. Must be called with
+// the lock held.
+func (ac *AlertChecker) currentInstance(instance *instanceDetails) *instanceDetails {
+	instances := ac.monitored
+	if !instance.ExpiredAt.IsZero() {
+		instances = ac.expired
+	}
+	if current, ok := instances[instance.Key]; ok {
+		return current
 	}
-	wg.Wait()
+	return instance
 }
 
-func (ac *AlertChecker) alert(wg *sync.WaitGroup, ctx context.Context, now time.Time, instance *instanceDetails) {
-	defer wg.Done()
+// alert makes the alert to send for an instance. Must be called with the lock
+// held.
+func (ac *AlertChecker) alert(ctx context.Context, now time.Time, instance *instanceDetails) *outgoing {
+	ctx = logging.NewContext(ctx, slog.String(logging.KeyInstance, instance.Key))
+	ctx, span := ac.startAlertSpan(ctx, "alertchecker.alert", instance)
+
+	alert, groupLabels := ac.makeAlert(instance, instance.OverrideLabels)
+
+	// We're here because the alert is either expired, active or resolved, it's
+	// active if the time is after the ActivateAt time.
+	if !instance.ExpiredAt.IsZero() {
+		// Final notification, this ends the alert.
+		alert.StartsAt = instance.ActivateAt
+		alert.EndsAt = instance.ExpiredAt
+		alert.Status = "expired"
+		alert.Annotations["expired"] = fmt.Sprintf("No heartbeat received for %v, prommsd has stopped alerting for this instance", instance.ExpiredAt.Sub(instance.ActivateAt).Round(time.Second))
+	} else if instance.firing(now) {
+		alert.StartsAt = instance.ActivateAt
+		if instance.HeldFiring {
+			alert.StartsAt = instance.ActivatedAt
+		}
+		if expiresAt, ok := instance.expiresAt(); ok {
+			alert.EndsAt = expiresAt
+		}
+		alert.Status = "firing"
+		if instance.Flapping {
+			alert.Annotations["flapping"] = fmt.Sprintf("%d firing/resolved transitions in the last %v, holding alert firing", len(instance.Transitions), ac.config.FlapWindow)
+		}
+	} else {
+		// Send resolved
+		alert.StartsAt = instance.ActivatedAt
+		alert.EndsAt = instance.ResolvedAt
+		alert.Status = "resolved"
+	}
 
+	span.SetAttributes(statusAttribute.String(alert.Status))
+	sk := sendingKey{"alert", instance.Key}
+	ac.sending[sk] = true
+	return &outgoing{
+		ctx:          ctx,
+		alert:        alert,
+		groupLabels:  groupLabels,
+		destinations: instance.AlertManagers,
+		receiver:     instance.Receiver,
+		lastSent:     instance.LastSent,
+		done: func(err error) {
+			endSpan(span, err)
+			ac.Lock()
+			defer ac.Unlock()
+			delete(ac.sending, sk)
+			instance := ac.currentInstance(instance)
+			if err != nil {
+				instance.LastError = deliveryError(err)
+				instance.DeliveryErrors++
+			} else {
+				instance.LastSent = now
+			}
+			if ac.monitored[instance.Key] == instance {
+				ac.scheduleCheck(instance.Key, instance, ac.now())
+			}
+		},
+	}
+}
+
+// makeAlert makes the alert to send for an instance, with the given override
+// labels, and the group labels for it. Timing and status are left for the
+// caller to fill in.
+func (ac *AlertChecker) makeAlert(instance *instanceDetails, overrideLabels []string) (alertmanager.Alert, map[string]string) {
 	alert := alertmanager.NewAlert()
 	for k, v := range instance.LastAlert.GetLabels() {
-		if k == "severity" || k == "alertname" {
+		// The replica label would change depending on which replica sent the
+		// last heartbeat, so can't be part of the alert.
+		if k == "severity" || k == "alertname" || (k == instance.ReplicaLabel && k != "") {
 			continue
 		}
 		alert.Labels[k] = v
 	}
 	alert.Labels["alertname"] = instance.AlertName
-	for _, override := range instance.OverrideLabels {
+	for _, override := range overrideLabels {
 		label := strings.SplitN(override, "=", 2)
 		if len(label) < 2 {
 			continue
@@ -259,28 +814,42 @@ func (ac *AlertChecker) alert(wg *sync.WaitGroup, ctx context.Context, now time.
 	}
 
 	alert.GeneratorURL = ac.externalURL
+	return alert, groupLabels
+}
 
-	// We're here because the alert is either active or resolved, it's active if the time is after the
-	// ActivateAt time.
-	resolved := false
-	if now.After(instance.ActivateAt) {
-		alert.StartsAt = instance.ActivateAt
-		alert.EndsAt = instance.ActivateAt.Add(expireTime)
-		alert.Status = "firing"
-	} else {
-		// Send resolved
-		alert.StartsAt = instance.ActivatedAt
-		alert.EndsAt = instance.ResolvedAt
-		alert.Status = "resolved"
-		resolved = true
+// makeKey turns the given identifier labels of an alert into a key.
+func makeKey(alert *alertmanager.Alert, identifiers []string) string {
+	var ids []string
+	for _, id := range identifiers {
+		ids = append(ids, id+"="+fmt.Sprintf("%q", alert.GetLabelDefault(id, "")))
 	}
+	sort.Strings(ids)
+	return strings.Join(ids, " ")
+}
+
+// expiresAt returns the time after which the instance should no longer alert,
+// ok is false if the instance never expires.
+func (i *instanceDetails) expiresAt() (t time.Time, ok bool) {
+	if i.ExpireAfter == neverExpire {
+		return time.Time{}, false
+	}
+	return i.ActivateAt.Add(i.ExpireAfter), true
+}
 
-	err := ac.sendAlerts(ctx, instance.AlertManagers, instance.Receiver, instance.LastSent, resolved, groupLabels, []alertmanager.Alert{alert})
+// parseExpire parses msd_expire, which is either a duration or "never".
+func parseExpire(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "never" {
+		return neverExpire, nil
+	}
+	d, err := time.ParseDuration(s)
 	if err != nil {
-		instance.LastError = err.Error()
-	} else {
-		instance.LastSent = now
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("expiry must be positive or \"never\", got %v", d)
 	}
+	return d, nil
 }
 
 // Split into "words", allowing lines to be commented.
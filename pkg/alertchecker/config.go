@@ -0,0 +1,184 @@
+package alertchecker
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const defaultSlackTemplate = "{{.Receiver}}:{{range $k, $v := .GroupLabels}} {{$k}}={{$v}}{{end}}{{range $k, $v := .CommonAnnotations}}\n{{$k}}: {{$v}}{{end}}"
+
+// Config holds the settings for an AlertChecker. See RegisterFlags for what
+// each setting does.
+type Config struct {
+	ExpiredRetention time.Duration
+	InhibitedBy      string
+	ArmAfter         string
+	SlackTemplate    string
+	HeartbeatMaxAge  time.Duration
+	IsolationWindow  time.Duration
+	WarmUp           time.Duration
+	RecoverFrom      string
+	Peers            string
+	PeerInterval     time.Duration
+	// PeerToken is the secret replicas share, required to fetch /-/state
+	// (which includes destinations and annotations).
+	PeerToken string
+
+	MassOutageThreshold int
+	MassOutagePercent   float64
+	MassOutageWindow    time.Duration
+	MassOutageSuppress  bool
+
+	FlapWindow    time.Duration
+	FlapThreshold int
+
+	AdaptiveSamples    int
+	AdaptivePercentile float64
+	AdaptiveFactor     float64
+
+	InstanceMetricsLimit int
+	IngestQueueSize      int
+
+	MaxBatchSize           int
+	DeliveryWorkers        int
+	DestinationConcurrency int
+
+	// Schedules are named schedules for msd_schedule, name to spec.
+	Schedules map[string]string
+}
+
+// DefaultConfig returns the default settings.
+func DefaultConfig() Config {
+	return Config{
+		ExpiredRetention:     24 * time.Hour,
+		SlackTemplate:        defaultSlackTemplate,
+		HeartbeatMaxAge:      5 * time.Minute,
+		MassOutageWindow:     5 * time.Minute,
+		FlapWindow:           time.Hour,
+		AdaptiveSamples:      50,
+		AdaptivePercentile:   0.95,
+		AdaptiveFactor:       3,
+		InstanceMetricsLimit: 1000,
+		IngestQueueSize:      10000,
+		PeerInterval:         5 * time.Second,
+		Schedules:            map[string]string{},
+
+		MaxBatchSize:           100,
+		DeliveryWorkers:        10,
+		DestinationConcurrency: 2,
+	}
+}
+
+// RegisterFlags registers command line flags for the settings on fs, using
+// the current values as defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.ExpiredRetention, "expired-retention", c.ExpiredRetention, "How long to show expired instances on the status page")
+	fs.StringVar(&c.InhibitedBy, "inhibited-by", c.InhibitedBy, "Default for msd_inhibited_by: labels identifying a parent instance which holds back alerts while it is firing")
+	fs.StringVar(&c.ArmAfter, "arm-after", c.ArmAfter, "Default for msd_arm_after: number of heartbeats and/or duration an instance must be seen for before it can alert")
+	fs.StringVar(&c.SlackTemplate, "slack-template", c.SlackTemplate, "Go text/template to use for formatting slack message")
+	fs.DurationVar(&c.HeartbeatMaxAge, "heartbeat-max-age", c.HeartbeatMaxAge, "Maximum age of a heartbeat, according to its msd_timestamp annotation, before it is treated as stale")
+	fs.DurationVar(&c.IsolationWindow, "isolation-window", c.IsolationWindow, "If no heartbeats at all are received for this long, send a single alert about prommsd not receiving heartbeats instead of per-instance alerts (0 to disable)")
+	fs.DurationVar(&c.WarmUp, "warm-up", c.WarmUp, "After starting, don't activate restored instances or report ready for this long, giving Alertmanager time to deliver heartbeats again")
+	fs.StringVar(&c.RecoverFrom, "recover-from", c.RecoverFrom, "Space separated Alertmanager URLs to recover instances and their firing alerts from on startup")
+	fs.StringVar(&c.Peers, "peers", c.Peers, "Space separated URLs of the other prommsd replicas (as their -external-url), to replicate state with and elect a single sender")
+	fs.DurationVar(&c.PeerInterval, "peer-interval", c.PeerInterval, "How often to fetch state from peers, a peer is considered down after 3 intervals without a successful fetch")
+	fs.Func("peer-token-file", "File containing a secret shared by all replicas, required with -peers to fetch state from them", func(path string) error {
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		c.PeerToken = strings.TrimSpace(string(token))
+		return nil
+	})
+
+	fs.IntVar(&c.MassOutageThreshold, "mass-outage-threshold", c.MassOutageThreshold, "Send a single summary alert when more than this many instances activate within -mass-outage-window (0 to disable)")
+	fs.Float64Var(&c.MassOutagePercent, "mass-outage-percent", c.MassOutagePercent, "Send a single summary alert when more than this percentage of monitored instances activate within -mass-outage-window (0 to disable)")
+	fs.DurationVar(&c.MassOutageWindow, "mass-outage-window", c.MassOutageWindow, "Window in which instances activating are considered part of the same mass outage")
+	fs.BoolVar(&c.MassOutageSuppress, "mass-outage-suppress", c.MassOutageSuppress, "Don't send per-instance alerts for instances covered by an active mass outage summary alert")
+
+	fs.DurationVar(&c.FlapWindow, "flap-window", c.FlapWindow, "Window over which firing/resolved transitions are counted for flap detection")
+	fs.IntVar(&c.FlapThreshold, "flap-threshold", c.FlapThreshold, "Number of firing/resolved transitions within -flap-window after which an instance is flapping and held firing (0 to disable)")
+
+	fs.IntVar(&c.AdaptiveSamples, "adaptive-samples", c.AdaptiveSamples, "Number of recent heartbeat intervals to keep per instance for adaptive activation")
+	fs.Float64Var(&c.AdaptivePercentile, "adaptive-percentile", c.AdaptivePercentile, "Percentile of heartbeat intervals to use for adaptive activation")
+	fs.Float64Var(&c.AdaptiveFactor, "adaptive-factor", c.AdaptiveFactor, "Safety factor to multiply the heartbeat interval percentile by for adaptive activation")
+
+	fs.IntVar(&c.InstanceMetricsLimit, "instance-metrics-limit", c.InstanceMetricsLimit, "Maximum number of instances to export per-instance metrics for (0 to disable per-instance metrics)")
+	fs.IntVar(&c.IngestQueueSize, "ingest-queue-size", c.IngestQueueSize, "Number of received heartbeats that can wait to be processed, when full heartbeats are rejected with 503 so the sender retries")
+
+	fs.IntVar(&c.MaxBatchSize, "max-batch-size", c.MaxBatchSize, "Maximum number of alerts to send to a destination in one request (0 for no limit)")
+	fs.IntVar(&c.DeliveryWorkers, "delivery-workers", c.DeliveryWorkers, "Number of notifications to send at once")
+	fs.IntVar(&c.DestinationConcurrency, "destination-concurrency", c.DestinationConcurrency, "Number of notifications to send to the same destination at once")
+
+	if c.Schedules == nil {
+		c.Schedules = map[string]string{}
+	}
+	fs.Var(scheduleFlag(c.Schedules), "schedule", "Named schedule for msd_schedule, as name=spec (e.g. \"office=Mon-Fri 08:00-18:00 Europe/London\"), can be repeated")
+}
+
+// scheduleFlag implements flag.Value for named schedules.
+type scheduleFlag map[string]string
+
+func (sf scheduleFlag) String() string {
+	var names []string
+	for name, spec := range sf {
+		names = append(names, name+"="+spec)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func (sf scheduleFlag) Set(v string) error {
+	nameSpec := strings.SplitN(v, "=", 2)
+	if len(nameSpec) != 2 {
+		return fmt.Errorf("expected name=spec, got %q", v)
+	}
+	if _, err := parseSchedule(nameSpec[1]); err != nil {
+		return err
+	}
+	sf[strings.TrimSpace(nameSpec[0])] = nameSpec[1]
+	return nil
+}
+
+type options struct {
+	config         Config
+	registerer     prometheus.Registerer
+	externalURL    string
+	notifiers      map[string]Notifier
+	tracerProvider oteltrace.TracerProvider
+	httpClient     *http.Client
+}
+
+// Option configures an AlertChecker created by New.
+type Option func(*options)
+
+// WithConfig sets the settings, otherwise DefaultConfig is used.
+func WithConfig(c Config) Option {
+	return func(o *options) {
+		o.config = c
+	}
+}
+
+// WithRegisterer registers the AlertChecker's metrics on r, otherwise they
+// aren't registered anywhere.
+func WithRegisterer(r prometheus.Registerer) Option {
+	return func(o *options) {
+		o.registerer = r
+	}
+}
+
+// WithExternalURL sets the URL where the status page is accessible to users,
+// used for links in alerts.
+func WithExternalURL(u string) Option {
+	return func(o *options) {
+		o.externalURL = u
+	}
+}
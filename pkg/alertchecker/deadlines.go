@@ -0,0 +1,163 @@
+package alertchecker
+
+import (
+	"container/heap"
+	"time"
+)
+
+// deadlineQueue holds the time each instance next needs checking, ordered so
+// the checker only looks at instances that are due.
+type deadlineQueue struct {
+	heap deadlineHeap
+	keys map[string]*deadline
+}
+
+type deadline struct {
+	key   string
+	at    time.Time
+	index int
+}
+
+func newDeadlineQueue() *deadlineQueue {
+	return &deadlineQueue{keys: map[string]*deadline{}}
+}
+
+// set sets when key next needs checking, replacing any existing deadline. A
+// zero time removes key.
+func (q *deadlineQueue) set(key string, at time.Time) {
+	if at.IsZero() {
+		q.remove(key)
+		return
+	}
+	if d, ok := q.keys[key]; ok {
+		d.at = at
+		heap.Fix(&q.heap, d.index)
+		return
+	}
+	d := &deadline{key: key, at: at}
+	q.keys[key] = d
+	heap.Push(&q.heap, d)
+}
+
+// remove removes the deadline for key, if there is one.
+func (q *deadlineQueue) remove(key string) {
+	if d, ok := q.keys[key]; ok {
+		heap.Remove(&q.heap, d.index)
+		delete(q.keys, key)
+	}
+}
+
+// next returns the earliest deadline, ok is false if there are none.
+func (q *deadlineQueue) next() (at time.Time, ok bool) {
+	if len(q.heap) == 0 {
+		return time.Time{}, false
+	}
+	return q.heap[0].at, true
+}
+
+// popDue removes and returns the keys with deadlines at or before now.
+func (q *deadlineQueue) popDue(now time.Time) []string {
+	var due []string
+	for len(q.heap) > 0 && !q.heap[0].at.After(now) {
+		d := heap.Pop(&q.heap).(*deadline)
+		delete(q.keys, d.key)
+		due = append(due, d.key)
+	}
+	return due
+}
+
+// Len returns the number of deadlines.
+func (q *deadlineQueue) Len() int {
+	return len(q.heap)
+}
+
+// deadlineHeap implements heap.Interface, earliest first.
+type deadlineHeap []*deadline
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h deadlineHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *deadlineHeap) Push(x any) {
+	d := x.(*deadline)
+	d.index = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	n := len(old)
+	d := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return d
+}
+
+// nextCheck returns when the instance next needs checking after now, based on
+// when it activates, would resend, stops sending resolved, expires or a
+// replica or flap transition ages out. Checking early is harmless, so where
+// unsure it errs early. A notification that could already be sent is checked
+// after retry. A zero time means it doesn't need checking.
+func (ac *AlertChecker) nextCheck(i *instanceDetails, now time.Time, retry time.Duration) time.Time {
+	var next time.Time
+	earliest := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	consider := func(t time.Time) {
+		// The checks are mostly now.After(t), so t itself is too early.
+		if t = t.Add(time.Nanosecond); t.After(now) {
+			earliest(t)
+		}
+	}
+	resend := func(lastSent time.Time) {
+		if t := lastSent.Add(sendInterval + time.Nanosecond); t.After(now) {
+			earliest(t)
+		} else {
+			earliest(now.Add(retry))
+		}
+	}
+
+	consider(i.ActivateAt)
+	if t, ok := i.expiresAt(); ok {
+		consider(t)
+	}
+	resolveEnd := i.ResolvedAt.Add(resolveRepeat)
+	consider(resolveEnd)
+	if i.firing(now) || now.Before(resolveEnd) {
+		resend(i.LastSent)
+	}
+
+	if i.Quorum > 0 {
+		for _, t := range i.Replicas {
+			consider(t)
+		}
+		consider(i.FirstSeen.Add(i.Activation))
+		degradedResolveEnd := i.DegradedResolvedAt.Add(resolveRepeat)
+		consider(degradedResolveEnd)
+		if i.Degraded() || now.Before(degradedResolveEnd) {
+			resend(i.DegradedLastSent)
+		}
+	}
+
+	if len(i.Transitions) > 0 {
+		// Transitions are only kept within the window, when the oldest ages
+		// out the instance may stop flapping.
+		consider(i.Transitions[0].Add(ac.config.FlapWindow))
+	}
+	return next
+}
+
+// scheduleCheck schedules the next check of instance, after it has been
+// checked. Must be called with the lock held.
+func (ac *AlertChecker) scheduleCheck(key string, instance *instanceDetails, now time.Time) {
+	// Anything that could be sent but wasn't (e.g. suppressed, or still being
+	// delivered) is checked again on the next regular check.
+	ac.deadlines.set(key, ac.nextCheck(instance, now, ac.checkInterval))
+}
@@ -0,0 +1,106 @@
+package alertchecker
+
+import (
+	"errors"
+	"log/slog"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+var (
+	lastSuccessDesc = prometheus.NewDesc(
+		"prommsd_delivery_seconds_since_last_success",
+		"Time since a notification was last successfully sent, by delivery type and destination",
+		[]string{"type", "destination"}, nil)
+)
+
+// deliveryCollector exports the time since the last successful delivery to
+// each destination, it also keeps the status of each destination for the
+// status endpoint.
+type deliveryCollector struct {
+	sync.Mutex
+	destinations map[[2]string]*DestinationStatus
+}
+
+func (dc *deliveryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lastSuccessDesc
+}
+
+func (dc *deliveryCollector) Collect(ch chan<- prometheus.Metric) {
+	dc.Lock()
+	defer dc.Unlock()
+	now := time.Now()
+	for k, d := range dc.destinations {
+		if !d.LastSuccess.IsZero() {
+			ch <- prometheus.MustNewConstMetric(lastSuccessDesc, prometheus.GaugeValue, now.Sub(d.LastSuccess).Seconds(), k[0], k[1])
+		}
+	}
+}
+
+// status returns the status of each destination, sorted by type and
+// destination.
+func (dc *deliveryCollector) status() []DestinationStatus {
+	dc.Lock()
+	defer dc.Unlock()
+	statuses := make([]DestinationStatus, 0, len(dc.destinations))
+	for _, d := range dc.destinations {
+		statuses = append(statuses, *d)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Type != statuses[j].Type {
+			return statuses[i].Type < statuses[j].Type
+		}
+		return statuses[i].Destination < statuses[j].Destination
+	})
+	return statuses
+}
+
+// recordDelivery records metrics for a delivery attempt.
+func (m *metrics) recordDelivery(deliverType, destination string, duration time.Duration, err error) {
+	labels := prometheus.Labels{"type": deliverType, "destination": destination}
+	m.deliverySent.With(labels).Add(1)
+	m.deliveryDuration.With(labels).Observe(duration.Seconds())
+	if err != nil {
+		m.deliveryFailed.With(labels).Add(1)
+	}
+
+	m.destinations.Lock()
+	defer m.destinations.Unlock()
+	key := [2]string{deliverType, destination}
+	d, ok := m.destinations.destinations[key]
+	if !ok {
+		d = &DestinationStatus{Type: deliverType, Destination: destination}
+		m.destinations.destinations[key] = d
+	}
+	if err != nil {
+		d.LastFailure = time.Now()
+		d.LastError = deliveryError(err)
+		d.ConsecutiveFailures++
+	} else {
+		d.LastSuccess = time.Now()
+		d.ConsecutiveFailures = 0
+	}
+	d.Healthy = d.ConsecutiveFailures == 0
+}
+
+// deliveryError returns the error as a string, without the URL from any
+// url.Error as it may contain secrets.
+func deliveryError(err error) string {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return ue.Op + ": " + ue.Err.Error()
+	}
+	return err.Error()
+}
+
+// deliveryErrorAttr returns a log attribute for a delivery error, redacted as
+// by deliveryError.
+func deliveryErrorAttr(err error) slog.Attr {
+	return slog.String(logging.KeyError, deliveryError(err))
+}
@@ -0,0 +1,51 @@
+package alertchecker
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+// recordTransition records the instance changing between firing and resolved.
+func (ac *AlertChecker) recordTransition(i *instanceDetails, now time.Time) {
+	if ac.config.FlapThreshold <= 0 {
+		return
+	}
+	i.Transitions = append(i.Transitions, now)
+}
+
+// checkFlapping drops transitions outside the window and updates whether the
+// instance is flapping. When an instance stops flapping and it was only being
+// held firing, it is resolved.
+func (ac *AlertChecker) checkFlapping(key string, i *instanceDetails, now time.Time) {
+	windowStart := now.Add(-ac.config.FlapWindow)
+	n := 0
+	for _, t := range i.Transitions {
+		if t.After(windowStart) {
+			i.Transitions[n] = t
+			n++
+		}
+	}
+	i.Transitions = i.Transitions[:n]
+
+	flapping := ac.config.FlapThreshold > 0 && n >= ac.config.FlapThreshold
+	if flapping && !i.Flapping {
+		slog.Warn("Instance is flapping", slog.String(logging.KeyInstance, key), slog.Int("transitions", n), slog.Duration("window", ac.config.FlapWindow))
+	} else if !flapping && i.Flapping {
+		slog.Info("Instance is no longer flapping", slog.String(logging.KeyInstance, key))
+		if i.HeldFiring {
+			i.HeldFiring = false
+			if !now.After(i.ActivateAt) {
+				i.ResolvedAt = now
+			}
+		}
+	}
+	i.Flapping = flapping
+}
+
+// firing returns true if the instance should be alerting, either because it
+// has activated or it is being held firing due to flapping.
+func (i *instanceDetails) firing(now time.Time) bool {
+	return now.After(i.ActivateAt) || i.HeldFiring
+}
@@ -0,0 +1,56 @@
+package alertchecker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/G-Research/prommsd/pkg/alertmanager"
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+// checkFreshness returns an error if the heartbeat is stale, i.e. it is being
+// replayed rather than Prometheus still evaluating it. If the heartbeat has an
+// msd_timestamp annotation lag is the time since it was evaluated.
+func (ac *AlertChecker) checkFreshness(ctx context.Context, now time.Time, alert *alertmanager.Alert) (lag time.Duration, lagOK bool, err error) {
+	// Prometheus keeps moving EndsAt forward while it is evaluating the alert.
+	// (Alertmanager hides EndsAt for firing alerts in webhooks, so this mostly
+	// catches other senders replaying old alerts.)
+	if !alert.EndsAt.IsZero() && now.After(alert.EndsAt) {
+		ac.metrics.stale.With(prometheus.Labels{"reason": "ends_at"}).Add(1)
+		return 0, false, fmt.Errorf("ended at %v", alert.EndsAt)
+	}
+
+	ts, ok := alert.GetAnnotation("msd_timestamp")
+	if !ok {
+		return 0, false, nil
+	}
+	t, err := parseTimestamp(ts)
+	if err != nil {
+		// Not the heartbeat's fault, so don't ignore it.
+		slog.WarnContext(ctx, "Failed to parse msd_timestamp, not checking freshness", slog.String("msd_timestamp", ts), logging.Err(err))
+		return 0, false, nil
+	}
+	lag = now.Sub(t)
+	if lag > ac.config.HeartbeatMaxAge {
+		ac.metrics.stale.With(prometheus.Labels{"reason": "timestamp"}).Add(1)
+		return lag, true, fmt.Errorf("evaluated %v ago", lag.Round(time.Second))
+	}
+	return lag, true, nil
+}
+
+// parseTimestamp parses a timestamp as Unix seconds (e.g. from Prometheus'
+// time()) or RFC 3339.
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9)), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,250 @@
+package alertchecker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// peerTimeoutIntervals is how many peer intervals without a successful fetch
+// until a peer is considered down.
+const peerTimeoutIntervals = 3
+
+// peer is a prommsd replica, including this one. The replicas are ordered by
+// URL, the first which is up sends notifications.
+type peer struct {
+	url  string
+	self bool
+	// lastSync is when state was last fetched from the peer, it starts as when
+	// this replica started, so peers have a chance to be fetched before this
+	// replica takes over from them.
+	lastSync  time.Time
+	lastError string
+}
+
+// newPeers returns the replicas, this one at self and the others at urls.
+func newPeers(self string, urls []string, now time.Time) []*peer {
+	peers := []*peer{{url: self, self: true, lastSync: now}}
+	for _, u := range urls {
+		u = strings.TrimSuffix(u, "/")
+		if u != strings.TrimSuffix(self, "/") {
+			peers = append(peers, &peer{url: u, lastSync: now})
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].url < peers[j].url })
+	return peers
+}
+
+// up returns true if the peer has been fetched from recently.
+func (p *peer) up(now time.Time, interval time.Duration) bool {
+	return p.self || now.Before(p.lastSync.Add(peerTimeoutIntervals*interval))
+}
+
+// currentSender returns the replica which should send notifications, the
+// first which is up, nil if there are no peers. Must be called with the lock
+// held.
+func (ac *AlertChecker) currentSender(now time.Time) *peer {
+	for _, p := range ac.peers {
+		if p.up(now, ac.config.PeerInterval) {
+			return p
+		}
+	}
+	return nil
+}
+
+// isSender returns true if this replica should send notifications. Must be
+// called with the lock held.
+func (ac *AlertChecker) isSender(now time.Time) bool {
+	p := ac.currentSender(now)
+	return p == nil || p.self
+}
+
+// checkSender records whether this replica is the sender, logging when that
+// changes. Must be called with the lock held.
+func (ac *AlertChecker) checkSender(now time.Time) bool {
+	sender := ac.isSender(now)
+	if len(ac.peers) > 0 && sender != ac.sender {
+		if sender {
+			slog.Warn("No peers ahead of this replica are up, sending notifications")
+		} else {
+			slog.Info("Another replica is sending notifications, standing by")
+		}
+	}
+	ac.sender = sender
+	if sender {
+		ac.metrics.sender.Set(1)
+	} else {
+		ac.metrics.sender.Set(0)
+	}
+	return sender
+}
+
+// syncPeers fetches state from the peers every PeerInterval, until ctx is done
+// or Shutdown is called.
+func (ac *AlertChecker) syncPeers(ctx context.Context) {
+	ticker := time.NewTicker(ac.config.PeerInterval)
+	defer ticker.Stop()
+	for {
+		for _, p := range ac.peers {
+			if !p.self {
+				ac.syncPeer(ctx, p)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ac.stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncPeer fetches the state of a peer and merges it.
+func (ac *AlertChecker) syncPeer(ctx context.Context, p *peer) {
+	state, err := fetchPeerState(ctx, ac.httpClient, p.url, ac.config.PeerToken, ac.config.PeerInterval)
+
+	ac.Lock()
+	defer ac.Unlock()
+	if err != nil {
+		ac.metrics.peerSyncErrors.Inc()
+		if p.lastError == "" {
+			slog.WarnContext(ctx, "Cannot fetch state from peer", slog.String("peer", p.url), deliveryErrorAttr(err))
+		}
+		p.lastError = deliveryError(err)
+		return
+	}
+	if p.lastError != "" {
+		slog.InfoContext(ctx, "Fetched state from peer again", slog.String("peer", p.url))
+	}
+	p.lastSync = ac.now()
+	p.lastError = ""
+	ac.mergePeerState(state, ac.now())
+}
+
+// fetchPeerState gets the state of a peer, as served on /-/state.
+func fetchPeerState(ctx context.Context, client *http.Client, peerURL, token string, timeout time.Duration) (*state, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", peerURL+"/-/state", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	state, err := decodeState(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding state: %w", err)
+	}
+	return state, nil
+}
+
+// mergePeerState merges the state of a peer. The copy of an instance with the
+// latest heartbeat wins, as heartbeats may only reach some replicas, unless it
+// was deleted since. When notifications were last sent is always taken from
+// whichever replica knows of the latest, so a replica taking over doesn't
+// repeat them. Must be called with the lock held.
+func (ac *AlertChecker) mergePeerState(s *state, now time.Time) {
+	for key, deletedAt := range s.Deleted {
+		if !deletedAt.After(ac.deleted[key]) {
+			continue
+		}
+		if ours, ok := ac.monitored[key]; ok {
+			if ours.LastHeartbeat.After(deletedAt) {
+				// Heard from since it was deleted.
+				continue
+			}
+			delete(ac.monitored, key)
+			ac.deadlines.remove(key)
+		}
+		delete(ac.expired, key)
+		ac.deleted[key] = deletedAt
+	}
+
+	for key, theirs := range s.Monitored {
+		if deletedAt, ok := ac.deleted[key]; ok && !theirs.LastHeartbeat.After(deletedAt) {
+			continue
+		}
+		ours, ok := ac.monitored[key]
+		if !ok {
+			if expired, ok := ac.expired[key]; ok && !theirs.LastHeartbeat.After(expired.LastHeartbeat) {
+				// Expired here, it will expire there too.
+				continue
+			}
+			ac.restoreSchedule(key, theirs)
+			ac.monitored[key] = theirs
+			delete(ac.expired, key)
+			delete(ac.deleted, key)
+			ac.deadlines.set(key, ac.nextCheck(theirs, now, 0))
+			continue
+		}
+
+		if theirs.LastHeartbeat.After(ours.LastHeartbeat) {
+			ac.restoreSchedule(key, theirs)
+			theirs.LastSent = latest(theirs.LastSent, ours.LastSent)
+			theirs.DegradedLastSent = latest(theirs.DegradedLastSent, ours.DegradedLastSent)
+			ac.monitored[key] = theirs
+			ours = theirs
+		} else {
+			ours.LastSent = latest(ours.LastSent, theirs.LastSent)
+			ours.DegradedLastSent = latest(ours.DegradedLastSent, theirs.DegradedLastSent)
+		}
+		ac.deadlines.set(key, ac.nextCheck(ours, now, 0))
+	}
+	mergeSummary(ac.outage, s.Outage)
+	mergeSummary(ac.isolation, s.Isolation)
+	ac.metrics.instances.Set(float64(len(ac.monitored)))
+}
+
+// mergeSummary takes when a summary alert was last sent from a peer's copy of
+// it. Each replica raises and resolves summary alerts itself, so only a copy
+// in the same state (firing or resolved) is the same alert.
+func mergeSummary(ours, theirs *summaryAlert) {
+	if ours != nil && theirs != nil && ours.Active() == theirs.Active() {
+		ours.LastSent = latest(ours.LastSent, theirs.LastSent)
+	}
+}
+
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// PeerStatus is the state of a replica, as seen by this one.
+type PeerStatus struct {
+	URL       string    `json:"url"`
+	Self      bool      `json:"self"`
+	Up        bool      `json:"up"`
+	LastSync  time.Time `json:"lastSync"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// peerStatus returns the status of the replicas. Must be called with the lock
+// held.
+func (ac *AlertChecker) peerStatus(now time.Time) []PeerStatus {
+	var status []PeerStatus
+	for _, p := range ac.peers {
+		status = append(status, PeerStatus{
+			URL:       p.url,
+			Self:      p.self,
+			Up:        p.up(now, ac.config.PeerInterval),
+			LastSync:  p.lastSync,
+			LastError: p.lastError,
+		})
+	}
+	return status
+}
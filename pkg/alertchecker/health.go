@@ -0,0 +1,151 @@
+package alertchecker
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+// defaultHealthTimeout is how long Healthy waits for the checker loop to
+// respond before considering it wedged.
+const defaultHealthTimeout = 5 * time.Second
+
+// Healthy returns false if the checker loop doesn't respond within the health
+// timeout, Run isn't running or prommsd appears to be isolated.
+func (ac *AlertChecker) Healthy() bool {
+	timeout := time.NewTimer(ac.healthTimeout)
+	defer timeout.Stop()
+	select {
+	case ac.healthChan <- nil:
+	case <-timeout.C:
+		slog.Error("Checker loop not responding", slog.Duration("timeout", ac.healthTimeout))
+		return false
+	case <-ac.stopChan:
+		return false
+	case <-ac.done:
+		return false
+	}
+
+	ac.RLock()
+	defer ac.RUnlock()
+	// If no heartbeats are arriving at all the problem is likely with this
+	// instance (or its ingress), rather than everything it monitors.
+	return ac.isolation == nil || !ac.isolation.Active()
+}
+
+// Ready returns true once Run has started and nothing is holding back
+// readiness (e.g. warming up), until Shutdown is called.
+func (ac *AlertChecker) Ready() bool {
+	select {
+	case <-ac.stopChan:
+		return false
+	default:
+	}
+	ac.RLock()
+	defer ac.RUnlock()
+	return ac.running && len(ac.notReady) == 0
+}
+
+// setNotReady sets whether reason is holding back readiness.
+func (ac *AlertChecker) setNotReady(reason string, notReady bool) {
+	ac.Lock()
+	defer ac.Unlock()
+	if notReady {
+		ac.notReady[reason] = true
+	} else {
+		delete(ac.notReady, reason)
+	}
+}
+
+// Status summarises the state of an AlertChecker, as served on /-/status.
+type Status struct {
+	Ready bool `json:"ready"`
+	// NotReady lists what is holding back readiness.
+	NotReady []string `json:"notReady,omitempty"`
+	Isolated bool     `json:"isolated"`
+	// WarmUpRemainingSeconds is how long until the warm-up is over, restored
+	// instances won't activate before then.
+	WarmUpRemainingSeconds float64 `json:"warmUpRemainingSeconds,omitempty"`
+
+	// LastCheck is when the checker loop last ran a check, LoopLagSeconds how
+	// late that check was.
+	LastCheck                time.Time `json:"lastCheck"`
+	LastCheckDurationSeconds float64   `json:"lastCheckDurationSeconds"`
+	LoopLagSeconds           float64   `json:"loopLagSeconds"`
+
+	Monitored              int `json:"monitored"`
+	Expired                int `json:"expired"`
+	HeartbeatQueue         int `json:"heartbeatQueue"`
+	HeartbeatQueueCapacity int `json:"heartbeatQueueCapacity"`
+
+	// Sender is whether this replica is sending notifications, Peers the
+	// replicas (see -peers) in the order they take over sending.
+	Sender bool         `json:"sender"`
+	Peers  []PeerStatus `json:"peers,omitempty"`
+
+	DeliveryQueue              int                 `json:"deliveryQueue"`
+	DeliveriesInFlight         int                 `json:"deliveriesInFlight"`
+	DeliveryQueueOldestSeconds float64             `json:"deliveryQueueOldestSeconds"`
+	Destinations               []DestinationStatus `json:"destinations"`
+}
+
+// DestinationStatus is the result of recent deliveries to a destination.
+type DestinationStatus struct {
+	Type string `json:"type"`
+	// Destination is the URL, without any secrets.
+	Destination string    `json:"destination"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastFailure time.Time `json:"lastFailure"`
+	LastError   string    `json:"lastError,omitempty"`
+	// ConsecutiveFailures is the number of failures since the last success,
+	// the destination is healthy if there are none.
+	ConsecutiveFailures int  `json:"consecutiveFailures"`
+	Healthy             bool `json:"healthy"`
+}
+
+// Status returns the current status.
+func (ac *AlertChecker) Status() Status {
+	ready := ac.Ready()
+	queued, running, oldest := ac.deliveries.stats()
+
+	ac.RLock()
+	defer ac.RUnlock()
+	s := Status{
+		Ready:                      ready,
+		Isolated:                   ac.isolation != nil && ac.isolation.Active(),
+		LastCheck:                  ac.lastCheck,
+		LastCheckDurationSeconds:   ac.lastCheckDuration.Seconds(),
+		LoopLagSeconds:             ac.loopLag.Seconds(),
+		Monitored:                  len(ac.monitored),
+		Expired:                    len(ac.expired),
+		HeartbeatQueue:             len(ac.handleChan),
+		HeartbeatQueueCapacity:     cap(ac.handleChan),
+		DeliveryQueue:              queued,
+		DeliveriesInFlight:         running,
+		DeliveryQueueOldestSeconds: oldest.Seconds(),
+		Destinations:               ac.metrics.destinations.status(),
+	}
+	now := ac.now()
+	if ac.warmingUp(now) {
+		s.WarmUpRemainingSeconds = ac.warmUpUntil.Sub(now).Seconds()
+	}
+	s.Sender = ac.isSender(now)
+	s.Peers = ac.peerStatus(now)
+	for reason := range ac.notReady {
+		s.NotReady = append(s.NotReady, reason)
+	}
+	sort.Strings(s.NotReady)
+	return s
+}
+
+// Responds to /-/status with Status as JSON.
+func (ac *AlertChecker) statusJSON(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ac.Status()); err != nil {
+		slog.ErrorContext(req.Context(), "Error serving status", logging.Err(err))
+	}
+}
@@ -0,0 +1,52 @@
+package alertchecker
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const isolationAlertName = "PrommsdNotReceivingHeartbeats"
+
+// checkIsolation updates ac.isolation and returns true if prommsd appears to
+// be isolated, i.e. it isn't receiving any heartbeats. Must be called with the
+// lock held.
+func (ac *AlertChecker) checkIsolation(now time.Time) bool {
+	isolated := ac.config.IsolationWindow > 0 && !ac.lastReceived.IsZero() && len(ac.monitored) > 0 &&
+		now.After(ac.lastReceived.Add(ac.config.IsolationWindow))
+
+	if isolated {
+		if ac.isolation == nil || !ac.isolation.Active() {
+			slog.Error("No heartbeats received, assuming prommsd is isolated", slog.Time("last_received", ac.lastReceived))
+			all := map[string]bool{}
+			for key := range ac.monitored {
+				all[key] = true
+			}
+			ac.isolation = &summaryAlert{AlertName: isolationAlertName, ActivatedAt: now}
+			ac.isolation.update(ac.monitored, all)
+			ac.isolation.Summary = "prommsd is not receiving heartbeats"
+			ac.isolation.Description = fmt.Sprintf("No heartbeats received from any of %d instances since %v, alerts for individual instances are not being sent.", len(all), ac.lastReceived.UTC().Format(time.RFC3339))
+		}
+	} else if ac.isolation != nil && ac.isolation.Active() {
+		slog.Info("Heartbeats received again, no longer isolated")
+		ac.isolation.ResolvedAt = now
+		ac.isolation.unsuppress(ac.monitored, nil)
+		// Give the other instances a chance to deliver heartbeats again before
+		// alerting for any that haven't alerted yet.
+		deferTo := now.Add(ac.config.IsolationWindow)
+		for _, instance := range ac.monitored {
+			if instance.LastSent.Before(instance.ActivateAt) && instance.ActivateAt.Before(deferTo) {
+				instance.ActivateAt = deferTo
+			}
+		}
+	} else if ac.isolation != nil && now.After(ac.isolation.ResolvedAt.Add(resolveRepeat)) {
+		ac.isolation = nil
+	}
+
+	if isolated {
+		ac.metrics.isolated.Set(1)
+	} else {
+		ac.metrics.isolated.Set(0)
+	}
+	return isolated
+}
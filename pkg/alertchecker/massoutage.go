@@ -0,0 +1,84 @@
+package alertchecker
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const massOutageAlertName = "PrommsdMassOutage"
+
+// exceedsMassOutage returns true if count activated instances out of total
+// monitored is considered a mass outage.
+func (ac *AlertChecker) exceedsMassOutage(count, total int) bool {
+	if ac.config.MassOutageThreshold > 0 && count > ac.config.MassOutageThreshold {
+		return true
+	}
+	// A single instance is never a mass outage, even if it is a large
+	// percentage of a small number of instances.
+	if ac.config.MassOutagePercent > 0 && count > 1 && total > 0 &&
+		float64(count)*100/float64(total) > ac.config.MassOutagePercent {
+		return true
+	}
+	return false
+}
+
+// activation is an instance activating, at is its ActivatedAt.
+type activation struct {
+	key string
+	at  time.Time
+}
+
+// checkMassOutage updates ac.outage and returns the set of instance keys which
+// should have their alerts suppressed. Must be called with the lock held, after
+// ActivatedAt has been updated for newly active instances.
+func (ac *AlertChecker) checkMassOutage(now time.Time) map[string]bool {
+	windowStart := now.Add(-ac.config.MassOutageWindow)
+	n := 0
+	for n < len(ac.activations) && ac.activations[n].at.Before(windowStart) {
+		n++
+	}
+	ac.activations = ac.activations[n:]
+	affected := map[string]bool{}
+	for _, a := range ac.activations {
+		if instance, ok := ac.monitored[a.key]; ok && now.After(instance.ActivateAt) && !instance.ActivatedAt.Before(windowStart) {
+			affected[a.key] = true
+		}
+	}
+
+	if ac.outage != nil && ac.outage.Active() {
+		// Instances stay part of the outage while they remain active.
+		for _, key := range ac.outage.Keys {
+			if instance, ok := ac.monitored[key]; ok && now.After(instance.ActivateAt) {
+				affected[key] = true
+			}
+		}
+		if ac.exceedsMassOutage(len(affected), len(ac.monitored)) {
+			ac.outage.unsuppress(ac.monitored, affected)
+			ac.outage.update(ac.monitored, affected)
+			ac.outage.describeMassOutage(ac.config.MassOutageWindow)
+		} else {
+			slog.Info("Mass outage resolved", slog.Int("active", len(affected)))
+			ac.outage.ResolvedAt = now
+			ac.outage.unsuppress(ac.monitored, nil)
+		}
+	} else if ac.exceedsMassOutage(len(affected), len(ac.monitored)) {
+		slog.Error("Mass outage detected", slog.Int("active", len(affected)), slog.Duration("window", ac.config.MassOutageWindow))
+		ac.outage = &summaryAlert{AlertName: massOutageAlertName, ActivatedAt: now}
+		ac.outage.update(ac.monitored, affected)
+		ac.outage.describeMassOutage(ac.config.MassOutageWindow)
+	} else if ac.outage != nil && now.After(ac.outage.ResolvedAt.Add(resolveRepeat)) {
+		ac.outage = nil
+	}
+
+	if ac.outage == nil || !ac.outage.Active() || !ac.config.MassOutageSuppress {
+		return nil
+	}
+	return affected
+}
+
+func (sa *summaryAlert) describeMassOutage(window time.Duration) {
+	sa.Summary = fmt.Sprintf("%d instances stopped sending heartbeats within %v", len(sa.Keys), window)
+	sa.Description = strings.Join(sa.Keys, "\n")
+}
@@ -0,0 +1,221 @@
+package alertchecker
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the metrics for an AlertChecker.
+type metrics struct {
+	instances        prometheus.Gauge
+	isolated         prometheus.Gauge
+	stale            *prometheus.CounterVec
+	deliveryLag      prometheus.Histogram
+	deliverySent     *prometheus.CounterVec
+	deliveryFailed   *prometheus.CounterVec
+	deliveryDuration *prometheus.HistogramVec
+	destinations     *deliveryCollector
+	queueDepth       prometheus.Gauge
+	queueWait        prometheus.Histogram
+	ingestCapacity   prometheus.Gauge
+	ingestRejected   prometheus.Counter
+	sender           prometheus.Gauge
+	peerSyncErrors   prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		instances: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "prommsd",
+			Subsystem: "alertchecker",
+			Name:      "monitored_instances"}),
+		isolated: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "prommsd",
+			Subsystem: "alertchecker",
+			Name:      "isolated",
+			Help:      "1 if no heartbeats have been received from any instance for -isolation-window"}),
+		stale: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "prommsd",
+			Subsystem: "alertchecker",
+			Name:      "stale_heartbeats_total",
+			Help:      "Heartbeats ignored because they were stale"},
+			[]string{"reason"}),
+		deliveryLag: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "prommsd",
+			Subsystem: "alertchecker",
+			Name:      "heartbeat_delivery_lag_seconds",
+			Help:      "Time between Prometheus evaluating a heartbeat (msd_timestamp) and it being received",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10)}),
+		deliverySent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "prommsd",
+			Subsystem: "delivery",
+			Name:      "sent_total",
+			Help:      "Notifications sent, by delivery type and destination"},
+			[]string{"type", "destination"}),
+		deliveryFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "prommsd",
+			Subsystem: "delivery",
+			Name:      "failed_total",
+			Help:      "Notifications that failed to send, by delivery type and destination"},
+			[]string{"type", "destination"}),
+		deliveryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "prommsd",
+			Subsystem: "delivery",
+			Name:      "duration_seconds",
+			Help:      "Time taken to send notifications, by delivery type and destination"},
+			[]string{"type", "destination"}),
+		destinations: &deliveryCollector{destinations: map[[2]string]*DestinationStatus{}},
+		queueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "prommsd",
+			Subsystem: "delivery",
+			Name:      "queue_depth",
+			Help:      "Notifications waiting to be sent"}),
+		queueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "prommsd",
+			Subsystem: "delivery",
+			Name:      "queue_wait_seconds",
+			Help:      "Time notifications waited in the queue before being sent",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8)}),
+		ingestCapacity: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "prommsd",
+			Subsystem: "alertchecker",
+			Name:      "heartbeat_queue_capacity",
+			Help:      "Number of received heartbeats that can wait to be processed (-ingest-queue-size)"}),
+		ingestRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "prommsd",
+			Subsystem: "alertchecker",
+			Name:      "heartbeats_rejected_total",
+			Help:      "Heartbeats rejected because the heartbeat queue was full"}),
+		sender: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "prommsd",
+			Subsystem: "ha",
+			Name:      "sender",
+			Help:      "1 if this replica is sending notifications, 0 if standing by for another (see -peers)"}),
+		peerSyncErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "prommsd",
+			Subsystem: "ha",
+			Name:      "peer_sync_errors_total",
+			Help:      "Failures fetching state from peers"}),
+	}
+	for _, reason := range []string{"ends_at", "timestamp"} {
+		m.stale.With(prometheus.Labels{"reason": reason}).Add(0)
+	}
+	return m
+}
+
+func (m *metrics) register(r prometheus.Registerer) {
+	r.MustRegister(m.instances, m.isolated, m.stale, m.deliveryLag,
+		m.deliverySent, m.deliveryFailed, m.deliveryDuration, m.destinations,
+		m.queueDepth, m.queueWait, m.ingestCapacity, m.ingestRejected,
+		m.sender, m.peerSyncErrors)
+}
+
+const (
+	instanceLastHeartbeatName = "prommsd_instance_last_heartbeat_timestamp_seconds"
+	instanceActivateAtName    = "prommsd_instance_activation_timestamp_seconds"
+	instanceFiringName        = "prommsd_instance_firing"
+	instanceLastSentName      = "prommsd_instance_last_sent_timestamp_seconds"
+	instanceErrorsName        = "prommsd_instance_delivery_errors_total"
+	instanceFlapName          = "prommsd_instance_flap_transitions"
+	instanceLagName           = "prommsd_instance_heartbeat_delivery_lag_seconds"
+)
+
+var instanceMetricsDroppedDesc = prometheus.NewDesc(
+	"prommsd_instance_metrics_dropped",
+	"Number of instances not exported in per-instance metrics due to -instance-metrics-limit, or having the same identifier labels as another instance",
+	nil, nil)
+
+// instanceCollector exports metrics for each monitored instance, labelled by
+// the instance's identifier labels. As instances can have different
+// identifiers, the label names are the union of all identifiers and only
+// exported via Collect (i.e. this is an unchecked collector). Instances with
+// different identifiers can end up with the same labels, only the first (by
+// key) is exported, as duplicate series would fail the whole scrape.
+type instanceCollector struct {
+	ac *AlertChecker
+}
+
+// Describe sends nothing, making this an unchecked collector as the label
+// names aren't known in advance.
+func (ic *instanceCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (ic *instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	ac := ic.ac
+	ac.RLock()
+	defer ac.RUnlock()
+
+	var keys []string
+	for key := range ac.monitored {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	dropped := 0
+	if len(keys) > ac.config.InstanceMetricsLimit {
+		dropped = len(keys) - ac.config.InstanceMetricsLimit
+		keys = keys[:ac.config.InstanceMetricsLimit]
+	}
+
+	labelSet := map[string]bool{}
+	for _, key := range keys {
+		for label := range ac.monitored[key].Identifiers {
+			labelSet[label] = true
+		}
+	}
+	var labels []string
+	for label := range labelSet {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(name, help, labels, nil)
+	}
+	lastHeartbeat := desc(instanceLastHeartbeatName, "When the last heartbeat was received")
+	activateAt := desc(instanceActivateAtName, "When the instance will activate if no heartbeat is received")
+	firing := desc(instanceFiringName, "1 if the instance is firing")
+	lastSent := desc(instanceLastSentName, "When an alert (or resolve) was last successfully sent")
+	errors := desc(instanceErrorsName, "Errors sending alerts for the instance")
+	flap := desc(instanceFlapName, "Number of firing/resolved transitions within -flap-window")
+	lag := desc(instanceLagName, "Time between Prometheus evaluating the last heartbeat (msd_timestamp) and it being received")
+
+	now := ac.now()
+	seen := map[string]bool{}
+	for _, key := range keys {
+		instance := ac.monitored[key]
+		values := make([]string, len(labels))
+		for i, label := range labels {
+			values[i] = instance.Identifiers[label]
+		}
+		series := strings.Join(values, "\xff")
+		if seen[series] {
+			dropped++
+			continue
+		}
+		seen[series] = true
+
+		isFiring := 0.0
+		if instance.firing(now) {
+			isFiring = 1
+		}
+		ch <- prometheus.MustNewConstMetric(lastHeartbeat, prometheus.GaugeValue, timestamp(instance.LastHeartbeat), values...)
+		ch <- prometheus.MustNewConstMetric(activateAt, prometheus.GaugeValue, timestamp(instance.ActivateAt), values...)
+		ch <- prometheus.MustNewConstMetric(firing, prometheus.GaugeValue, isFiring, values...)
+		ch <- prometheus.MustNewConstMetric(lastSent, prometheus.GaugeValue, timestamp(instance.LastSent), values...)
+		ch <- prometheus.MustNewConstMetric(errors, prometheus.CounterValue, float64(instance.DeliveryErrors), values...)
+		ch <- prometheus.MustNewConstMetric(flap, prometheus.GaugeValue, float64(len(instance.Transitions)), values...)
+		ch <- prometheus.MustNewConstMetric(lag, prometheus.GaugeValue, instance.DeliveryLag.Seconds(), values...)
+	}
+	ch <- prometheus.MustNewConstMetric(instanceMetricsDroppedDesc, prometheus.GaugeValue, float64(dropped))
+}
+
+// timestamp returns t as Unix seconds, or 0 if t is unset.
+func timestamp(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
@@ -0,0 +1,73 @@
+package alertchecker
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/G-Research/prommsd/pkg/alertmanager"
+)
+
+// defaultDeliverType is used for destination URLs without a type prefix.
+const defaultDeliverType = "am"
+
+// Notification is a notification to send to a destination.
+type Notification struct {
+	// URL is the destination, with the delivery type prefix removed from the
+	// scheme (e.g. "slack+https://..." is "https://...").
+	URL      *url.URL
+	Receiver string
+	// Status is one of "firing", "resolved" or "expired".
+	Status      string
+	GroupLabels map[string]string
+	Alerts      []alertmanager.Alert
+}
+
+// Capabilities describe how notifications should be sent to a Notifier.
+type Capabilities struct {
+	// SupportsResolve is true if resolved notifications should be sent.
+	SupportsResolve bool
+	// MinRepeatInterval is the minimum time between notifications about the
+	// same alert. This may mean resolves aren't always sent. Expiry is only
+	// sent once, so is always sent.
+	MinRepeatInterval time.Duration
+	// Batch is true if a notification can contain multiple alerts with
+	// different labels, otherwise each alert is sent separately.
+	Batch bool
+}
+
+// Notifier sends notifications for a delivery type. Destination URLs of the
+// form type+scheme://... (e.g. "webhook+https://...") use the notifier
+// registered for type, URLs without a type use Alertmanager.
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+	Capabilities() Capabilities
+}
+
+// WithNotifier registers n for the delivery type, replacing any existing
+// notifier for it. The built in types are "am", "webhook" and "slack".
+func WithNotifier(deliverType string, n Notifier) Option {
+	return func(o *options) {
+		if o.notifiers == nil {
+			o.notifiers = map[string]Notifier{}
+		}
+		o.notifiers[deliverType] = n
+	}
+}
+
+// alertmanagerNotifier sends to Alertmanager's API, with clients from
+// newClient.
+type alertmanagerNotifier struct {
+	newClient func(*url.URL) *alertmanager.Client
+}
+
+func (an *alertmanagerNotifier) Capabilities() Capabilities {
+	return Capabilities{SupportsResolve: true, Batch: true}
+}
+
+func (an *alertmanagerNotifier) Notify(ctx context.Context, n *Notification) error {
+	client := an.newClient(n.URL)
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+	return client.SendAlerts(ctx, n.Alerts)
+}
@@ -0,0 +1,161 @@
+package alertchecker
+
+import (
+	"sync"
+	"time"
+)
+
+// deliveryQueue runs deliveries on a fixed number of workers, with at most
+// perDestination deliveries to the same destination in progress at once. Jobs
+// are started in the order they were queued, except jobs for a destination at
+// its limit wait without holding up jobs for other destinations.
+type deliveryQueue struct {
+	mu             sync.Mutex
+	cond           *sync.Cond
+	jobs           []*deliveryJob
+	inFlight       map[string]int
+	running        int
+	workers        int
+	perDestination int
+	started        bool
+	stopping       bool
+	wg             sync.WaitGroup
+	metrics        *metrics
+}
+
+type deliveryJob struct {
+	destination string
+	queuedAt    time.Time
+	run         func()
+}
+
+func newDeliveryQueue(workers, perDestination int, m *metrics) *deliveryQueue {
+	q := &deliveryQueue{
+		inFlight:       map[string]int{},
+		workers:        workers,
+		perDestination: perDestination,
+		metrics:        m,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// start starts the workers, if they aren't already running.
+func (q *deliveryQueue) start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.started {
+		return
+	}
+	q.started = true
+	q.stopping = false
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+}
+
+// stop waits for all queued jobs to complete, then stops the workers.
+func (q *deliveryQueue) stop() {
+	q.mu.Lock()
+	if !q.started {
+		q.mu.Unlock()
+		return
+	}
+	q.stopping = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	q.wg.Wait()
+
+	q.mu.Lock()
+	q.started = false
+	q.mu.Unlock()
+}
+
+// enqueue queues run to be called on a worker, counting towards the limit for
+// destination.
+func (q *deliveryQueue) enqueue(destination string, run func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = append(q.jobs, &deliveryJob{
+		destination: destination,
+		queuedAt:    time.Now(),
+		run:         run,
+	})
+	q.metrics.queueDepth.Set(float64(len(q.jobs)))
+	q.cond.Broadcast()
+}
+
+// wait blocks until there are no jobs queued or running.
+func (q *deliveryQueue) wait() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) > 0 || q.running > 0 {
+		q.cond.Wait()
+	}
+}
+
+// stats returns the number of jobs queued and running, and how long the
+// oldest queued job has been waiting.
+func (q *deliveryQueue) stats() (queued, running int, oldest time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.jobs) > 0 {
+		oldest = time.Since(q.jobs[0].queuedAt)
+	}
+	return len(q.jobs), q.running, oldest
+}
+
+// oldest returns how long the oldest queued job has been waiting.
+func (q *deliveryQueue) oldest() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.jobs) == 0 {
+		return 0
+	}
+	return time.Since(q.jobs[0].queuedAt)
+}
+
+func (q *deliveryQueue) worker() {
+	defer q.wg.Done()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		job := q.next()
+		if job == nil {
+			if q.stopping && len(q.jobs) == 0 {
+				return
+			}
+			q.cond.Wait()
+			continue
+		}
+
+		q.inFlight[job.destination]++
+		q.running++
+		q.metrics.queueDepth.Set(float64(len(q.jobs)))
+		q.metrics.queueWait.Observe(time.Since(job.queuedAt).Seconds())
+		q.mu.Unlock()
+
+		job.run()
+
+		q.mu.Lock()
+		q.running--
+		if q.inFlight[job.destination]--; q.inFlight[job.destination] == 0 {
+			delete(q.inFlight, job.destination)
+		}
+		// Wake workers waiting on this destination's limit, and wait.
+		q.cond.Broadcast()
+	}
+}
+
+// next removes and returns the first job whose destination is below its
+// limit, nil if there isn't one. Must be called with mu held.
+func (q *deliveryQueue) next() *deliveryJob {
+	for i, job := range q.jobs {
+		if q.inFlight[job.destination] < q.perDestination {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return job
+		}
+	}
+	return nil
+}
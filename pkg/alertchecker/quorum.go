@@ -0,0 +1,146 @@
+package alertchecker
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/G-Research/prommsd/pkg/alertmanager"
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+// parseReplicas parses the replica and quorum annotations of alert into
+// instance.
+func parseReplicas(alert *alertmanager.Alert, replicaLabel string, instance *instanceDetails) {
+	instance.ReplicaLabel = replicaLabel
+	instance.Replica = alert.GetLabelDefault(replicaLabel, "")
+	quorum, err := strconv.Atoi(strings.TrimSpace(alert.GetAnnotationDefault("msd_quorum", "0")))
+	if err != nil {
+		slog.Warn("Failed to parse msd_quorum, not alerting for quorum", slog.String(logging.KeyInstance, instance.Key), logging.Err(err))
+	}
+	instance.Quorum = quorum
+	instance.QuorumOverrideLabels = splitAnnotation(alert.GetAnnotationDefault("msd_quorum_override_labels", "severity=warning"))
+}
+
+// mergeReplicas combines the replicas known for oldInstance (which may be
+// nil) with the replica that sent the heartbeat for instance. The instance only
+// activates once all replicas are missing.
+func mergeReplicas(now time.Time, oldInstance, instance *instanceDetails) {
+	instance.Replicas = map[string]time.Time{}
+	if oldInstance != nil {
+		for replica, activateAt := range oldInstance.Replicas {
+			// Forget replicas that have been missing for longer than the instance
+			// would alert for.
+			if instance.ExpireAfter != neverExpire && now.After(activateAt.Add(instance.ExpireAfter)) {
+				continue
+			}
+			instance.Replicas[replica] = activateAt
+		}
+		instance.DegradedAt = oldInstance.DegradedAt
+		instance.DegradedResolvedAt = oldInstance.DegradedResolvedAt
+		instance.DegradedLastSent = oldInstance.DegradedLastSent
+		instance.DegradedLastError = oldInstance.DegradedLastError
+	}
+	instance.Replicas[instance.Replica] = instance.ActivateAt
+	for _, activateAt := range instance.Replicas {
+		if activateAt.After(instance.ActivateAt) {
+			instance.ActivateAt = activateAt
+		}
+	}
+}
+
+// missingReplicas returns the replicas that haven't sent a heartbeat within
+// the activation time.
+func (i *instanceDetails) missingReplicas(now time.Time) []string {
+	var missing []string
+	for replica, activateAt := range i.Replicas {
+		if now.After(activateAt) {
+			missing = append(missing, replica)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// Degraded returns true if the instance is below its quorum.
+func (i *instanceDetails) Degraded() bool {
+	return !i.DegradedAt.IsZero() && i.DegradedResolvedAt.IsZero()
+}
+
+// checkQuorum updates the degraded state of the instance, returning true if a
+// notification about it should be sent.
+func (i *instanceDetails) checkQuorum(now time.Time) bool {
+	if i.Quorum <= 0 {
+		return false
+	}
+
+	live := len(i.Replicas) - len(i.missingReplicas(now))
+	// Replicas that have never been seen only count as missing once the
+	// instance has been around long enough for them to have sent a heartbeat.
+	degraded := now.Before(i.ActivateAt) && live < i.Quorum &&
+		(live < len(i.Replicas) || now.After(i.FirstSeen.Add(i.Activation)))
+
+	if degraded && !i.Degraded() {
+		slog.Warn("Below quorum", slog.String(logging.KeyInstance, i.Key), slog.Int("live", live), slog.Int("quorum", i.Quorum))
+		i.DegradedAt = now
+		i.DegradedResolvedAt = time.Time{}
+	} else if !degraded && i.Degraded() {
+		i.DegradedResolvedAt = now
+	}
+
+	// Only send resolved if the degraded alert was sent.
+	sendResolved := !i.DegradedResolvedAt.IsZero() && now.Before(i.DegradedResolvedAt.Add(resolveRepeat)) &&
+		!i.DegradedLastSent.Before(i.DegradedAt)
+	return (i.Degraded() || sendResolved) && now.After(i.DegradedLastSent.Add(sendInterval))
+}
+
+// alertDegraded makes the degraded alert to send for an instance. Must be
+// called with the lock held.
+func (ac *AlertChecker) alertDegraded(ctx context.Context, now time.Time, instance *instanceDetails) *outgoing {
+	ctx = logging.NewContext(ctx, slog.String(logging.KeyInstance, instance.Key))
+	ctx, span := ac.startAlertSpan(ctx, "alertchecker.alertDegraded", instance)
+
+	var overrideLabels []string
+	overrideLabels = append(overrideLabels, instance.OverrideLabels...)
+	overrideLabels = append(overrideLabels, instance.QuorumOverrideLabels...)
+	alert, groupLabels := ac.makeAlert(instance, overrideLabels)
+
+	alert.StartsAt = instance.DegradedAt
+	if instance.Degraded() {
+		alert.Status = "firing"
+		alert.Annotations["missing_replicas"] = strings.Join(instance.missingReplicas(now), " ")
+	} else {
+		alert.EndsAt = instance.DegradedResolvedAt
+		alert.Status = "resolved"
+	}
+
+	span.SetAttributes(statusAttribute.String(alert.Status))
+	sk := sendingKey{"degraded", instance.Key}
+	ac.sending[sk] = true
+	return &outgoing{
+		ctx:          ctx,
+		alert:        alert,
+		groupLabels:  groupLabels,
+		destinations: instance.AlertManagers,
+		receiver:     instance.Receiver,
+		lastSent:     instance.DegradedLastSent,
+		done: func(err error) {
+			endSpan(span, err)
+			ac.Lock()
+			defer ac.Unlock()
+			delete(ac.sending, sk)
+			instance := ac.currentInstance(instance)
+			if err != nil {
+				instance.DegradedLastError = deliveryError(err)
+			} else {
+				instance.DegradedLastSent = now
+			}
+			if ac.monitored[instance.Key] == instance {
+				ac.scheduleCheck(instance.Key, instance, ac.now())
+			}
+		},
+	}
+}
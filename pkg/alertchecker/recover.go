@@ -0,0 +1,256 @@
+package alertchecker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/G-Research/prommsd/pkg/alertmanager"
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+const recoveringReason = "recovering"
+
+// Recover rebuilds instances from the alerts the Alertmanagers in RecoverFrom
+// currently have. Heartbeats recreate instances which aren't already known (as
+// if just received) and alerts this prommsd sent restore when instances
+// activated and that they are firing. Like restored instances, recovered
+// instances are subject to the warm-up. It may run alongside Run, heartbeats
+// received meanwhile take precedence; until it returns the checker isn't
+// ready.
+func (ac *AlertChecker) Recover(ctx context.Context) error {
+	defer ac.setNotReady(recoveringReason, false)
+	sources := strings.Fields(ac.config.RecoverFrom)
+	if len(sources) == 0 {
+		return nil
+	}
+
+	// The Alertmanagers are queried at once, a slow one mustn't hold up
+	// recovering from the rest.
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source string) {
+			defer wg.Done()
+			errs[i] = ac.recoverFrom(ctx, source)
+		}(i, source)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// recoverFrom recovers from the Alertmanager at source.
+func (ac *AlertChecker) recoverFrom(ctx context.Context, source string) error {
+	u, err := url.Parse(source)
+	if err != nil {
+		return fmt.Errorf("recover: %w", err)
+	}
+	alerts, err := ac.alertmanagerClient(u).GetAlerts(ctx)
+	if err != nil {
+		return fmt.Errorf("recover from %v: %s", logging.RedactURL(u), deliveryError(err))
+	}
+	recovered, firing := ac.recover(ctx, source, alerts)
+	slog.InfoContext(ctx, "Recovered from Alertmanager", logging.Destination(u), slog.Int("instances", recovered), slog.Int("firing", firing))
+	return nil
+}
+
+// recover adds the instances for the heartbeats in alerts from the
+// Alertmanager at source, then restores the alerts this prommsd sent. It
+// returns how many instances were added and how many restored as firing.
+func (ac *AlertChecker) recover(ctx context.Context, source string, alerts []alertmanager.APIAlert) (recovered, firing int) {
+	heartbeats := map[string]*instanceDetails{}
+	var own []alertmanager.APIAlert
+	for i := range alerts {
+		a := &alerts[i]
+		if ac.externalURL != "" && a.GeneratorURL == ac.externalURL {
+			own = append(own, *a)
+		} else if isHeartbeat(a) && a.Status.State == "active" {
+			alert := a.Alert(source)
+			key := heartbeatKey(alert)
+			instance := ac.newInstance(ctx, key, alert)
+			instance.recoverArmed(a.StartsAt, ac.now())
+			heartbeats[key] = instance
+		}
+	}
+
+	ac.Lock()
+	defer ac.Unlock()
+	now := ac.now()
+	// Instances recovered here, which unlike instances already known haven't
+	// had a heartbeat since starting.
+	fromAlertmanager := map[*instanceDetails]bool{}
+	for key, instance := range heartbeats {
+		if _, ok := ac.monitored[key]; ok {
+			continue
+		}
+		ac.monitored[key] = instance
+		fromAlertmanager[instance] = true
+		ac.deferForWarmUp(instance, now)
+		ac.deadlines.set(key, ac.nextCheck(instance, now, 0))
+		recovered++
+	}
+
+	// Our alerts are matched to instances by the labels they would be sent
+	// with.
+	byLabels := map[string]*instanceDetails{}
+	for _, instance := range ac.monitored {
+		if instance.LastAlert != nil {
+			alert, _ := ac.makeAlert(instance, instance.OverrideLabels)
+			byLabels[labelsKey(alert.Labels)] = instance
+		}
+	}
+	for _, a := range own {
+		if name := a.Labels["alertname"]; name == isolationAlertName || name == massOutageAlertName {
+			continue
+		}
+		if _, ok := a.Annotations["missing_replicas"]; ok {
+			// Degraded, which resolves itself once the replicas are back.
+			continue
+		}
+		instance, ok := byLabels[labelsKey(a.Labels)]
+		if !ok {
+			instance = instanceFromAlert(a, source, now)
+			if _, ok := ac.monitored[instance.Key]; ok {
+				slog.WarnContext(ctx, "Not recovering alert which doesn't match its instance", slog.String(logging.KeyInstance, instance.Key))
+				continue
+			}
+			ac.monitored[instance.Key] = instance
+			byLabels[labelsKey(a.Labels)] = instance
+			fromAlertmanager[instance] = true
+			recovered++
+		}
+		if !fromAlertmanager[instance] && instance.LastHeartbeat.After(a.StartsAt) {
+			// A heartbeat since it fired (e.g. received while recovering)
+			// wins, so it is resolved rather than fired again.
+			if instance.restoreResolved(a, now) {
+				ac.deadlines.set(instance.Key, ac.nextCheck(instance, now, 0))
+			}
+			continue
+		}
+		if instance.restoreFiring(a, now) {
+			ac.deadlines.set(instance.Key, ac.nextCheck(instance, now, 0))
+			firing++
+		}
+	}
+	ac.metrics.instances.Set(float64(len(ac.monitored)))
+	return recovered, firing
+}
+
+// isHeartbeat returns true if a is a heartbeat, i.e. has any msd_ annotations.
+func isHeartbeat(a *alertmanager.APIAlert) bool {
+	for k := range a.Annotations {
+		if strings.HasPrefix(k, "msd_") {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverArmed arms an instance recovered from a heartbeat Alertmanager has
+// had since startsAt. How many heartbeats that was isn't known, so only the
+// duration of msd_arm_after can keep it unarmed.
+func (i *instanceDetails) recoverArmed(startsAt, now time.Time) {
+	if !startsAt.IsZero() && startsAt.Before(i.FirstSeen) {
+		i.FirstSeen = startsAt
+	}
+	if i.ArmAfterDuration <= 0 {
+		i.Armed = true
+		return
+	}
+	i.checkArmed(now)
+}
+
+// restoreFiring restores an instance as firing since a, an alert sent for it,
+// unless it already is. It returns true if the instance was changed.
+func (i *instanceDetails) restoreFiring(a alertmanager.APIAlert, now time.Time) bool {
+	if now.After(i.ActivateAt) && i.LastSent.After(i.ActivateAt) {
+		return false
+	}
+	i.ActivateAt = a.StartsAt
+	i.ActivatedAt = a.StartsAt
+	// When Alertmanager last received it is the best guess at when it was
+	// last sent, it must be after activating to count as sent.
+	i.LastSent = a.UpdatedAt
+	if !i.LastSent.After(a.StartsAt) {
+		i.LastSent = now
+	}
+	i.Armed = true
+	return true
+}
+
+// restoreResolved records that a, an alert sent for an instance which has had
+// a heartbeat since, was sent so it is resolved, unless it already has been.
+// It returns true if the instance was changed.
+func (i *instanceDetails) restoreResolved(a alertmanager.APIAlert, now time.Time) bool {
+	if i.ResolvedAt.After(a.StartsAt) || i.HeldFiring {
+		return false
+	}
+	i.ActivatedAt = a.StartsAt
+	i.ResolvedAt = now
+	if a.UpdatedAt.After(i.LastSent) {
+		i.LastSent = a.UpdatedAt
+	}
+	return true
+}
+
+// instanceFromAlert recreates an instance from an alert this prommsd sent for
+// it, for when there's no heartbeat to recreate it from. Only what the alert
+// carries can be recovered: the instance is identified by the default
+// identifiers, alerts only to source and has the default activation and
+// expiry.
+func instanceFromAlert(a alertmanager.APIAlert, source string, now time.Time) *instanceDetails {
+	last := alertmanager.NewAlert()
+	var overrideLabels []string
+	for k, v := range a.Labels {
+		switch k {
+		case "alertname":
+		case "severity":
+			// Not copied from the heartbeat, so must have been an override.
+			overrideLabels = append(overrideLabels, "severity="+v)
+		default:
+			last.Labels[k] = v
+		}
+	}
+	for k, v := range a.Annotations {
+		if k != "expired" && k != "flapping" {
+			last.Annotations[annotationPrefix+k] = v
+		}
+	}
+
+	ids := splitAnnotation(defaultIdentifiers)
+	identifiers := map[string]string{}
+	for _, id := range ids {
+		identifiers[id] = last.GetLabelDefault(id, "")
+	}
+	return &instanceDetails{
+		FirstSeen:      now,
+		Activation:     defaultActivation,
+		ExpireAfter:    expireTime,
+		AlertName:      a.Labels["alertname"],
+		AlertManagers:  []string{source},
+		OverrideLabels: overrideLabels,
+		LastAlert:      &last,
+		Identifiers:    identifiers,
+		Key:            makeKey(&last, ids),
+	}
+}
+
+// labelsKey turns a set of labels into a string, for comparison.
+func labelsKey(labels map[string]string) string {
+	var l []string
+	for k, v := range labels {
+		l = append(l, k+"="+strconv.Quote(v))
+	}
+	sort.Strings(l)
+	return strings.Join(l, " ")
+}
@@ -0,0 +1,231 @@
+package alertchecker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// schedule is a set of windows during which heartbeats are expected.
+type schedule struct {
+	spec    string
+	windows []scheduleWindow
+}
+
+// scheduleWindow is a time of day range on some days of the week, in a time
+// zone. If end is before start the window runs past midnight.
+type scheduleWindow struct {
+	days       [7]bool
+	start, end time.Duration
+	loc        *time.Location
+}
+
+// getSchedule returns the named schedule, or parses spec as a schedule.
+func (ac *AlertChecker) getSchedule(spec string) (*schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if s, ok := ac.schedules[spec]; ok {
+		return s, nil
+	}
+	// Inline schedules are cached, to avoid parsing on every heartbeat.
+	if s, ok := ac.scheduleCache.Load(spec); ok {
+		return s.(*schedule), nil
+	}
+	s, err := parseSchedule(spec)
+	if err != nil {
+		return nil, err
+	}
+	ac.scheduleCache.Store(spec, s)
+	return s, nil
+}
+
+// parseSchedule parses a schedule: windows separated by ";" or newlines, each
+// of the form "DAYS HH:MM-HH:MM [TIMEZONE]". DAYS is "*" or a comma separated
+// list of days or day ranges, e.g. "Mon-Fri" or "Mon,Wed-Fri". Lines starting
+// with # are ignored.
+func parseSchedule(spec string) (*schedule, error) {
+	s := &schedule{spec: spec}
+	for _, line := range strings.Split(spec, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		for _, w := range strings.Split(line, ";") {
+			if strings.TrimSpace(w) == "" {
+				continue
+			}
+			window, err := parseScheduleWindow(w)
+			if err != nil {
+				return nil, err
+			}
+			s.windows = append(s.windows, window)
+		}
+	}
+	if len(s.windows) == 0 {
+		return nil, fmt.Errorf("schedule %q has no windows", spec)
+	}
+	return s, nil
+}
+
+func parseScheduleWindow(w string) (scheduleWindow, error) {
+	var window scheduleWindow
+	fields := strings.Fields(w)
+	if len(fields) < 2 || len(fields) > 3 {
+		return window, fmt.Errorf("expected \"DAYS HH:MM-HH:MM [TIMEZONE]\", got %q", w)
+	}
+
+	if fields[0] == "*" {
+		for i := range window.days {
+			window.days[i] = true
+		}
+	} else {
+		for _, r := range strings.Split(fields[0], ",") {
+			days := strings.SplitN(r, "-", 2)
+			first, ok := dayNames[strings.ToLower(days[0])]
+			if !ok {
+				return window, fmt.Errorf("unknown day %q in %q", days[0], w)
+			}
+			last := first
+			if len(days) == 2 {
+				if last, ok = dayNames[strings.ToLower(days[1])]; !ok {
+					return window, fmt.Errorf("unknown day %q in %q", days[1], w)
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				window.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return window, fmt.Errorf("expected HH:MM-HH:MM, got %q", fields[1])
+	}
+	var err error
+	if window.start, err = parseTimeOfDay(times[0]); err != nil {
+		return window, err
+	}
+	if window.end, err = parseTimeOfDay(times[1]); err != nil {
+		return window, err
+	}
+
+	window.loc = time.UTC
+	if len(fields) == 3 {
+		if window.loc, err = time.LoadLocation(fields[2]); err != nil {
+			return window, err
+		}
+	}
+	return window, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	hm := strings.SplitN(s, ":", 2)
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("expected HH:MM, got %q", s)
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("bad hour in %q", s)
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("bad minute in %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// dayStart returns the start of the window offsetDays after the day of t, in
+// the window's time zone.
+func (w scheduleWindow) dayStart(t time.Time, offsetDays int) time.Time {
+	y, m, d := t.Date()
+	h := int(w.start / time.Hour)
+	min := int((w.start % time.Hour) / time.Minute)
+	return time.Date(y, m, d+offsetDays, h, min, 0, 0, w.loc)
+}
+
+// Active returns true if t is within the window.
+func (w scheduleWindow) Active(t time.Time) bool {
+	lt := t.In(w.loc)
+	y, m, d := lt.Date()
+	offset := lt.Sub(time.Date(y, m, d, 0, 0, 0, 0, w.loc))
+	if w.start < w.end {
+		return w.days[lt.Weekday()] && offset >= w.start && offset < w.end
+	}
+	// Runs past midnight, so may have started yesterday.
+	yesterday := (lt.Weekday() + 6) % 7
+	return (w.days[lt.Weekday()] && offset >= w.start) || (w.days[yesterday] && offset < w.end)
+}
+
+// nextStart returns the next time after t that the window starts.
+func (w scheduleWindow) nextStart(t time.Time) time.Time {
+	lt := t.In(w.loc)
+	for i := 0; i <= 7; i++ {
+		start := w.dayStart(lt, i)
+		if w.days[start.Weekday()] && start.After(t) {
+			return start
+		}
+	}
+	return time.Time{}
+}
+
+// Active returns true if t is within any window of the schedule.
+func (s *schedule) Active(t time.Time) bool {
+	for _, w := range s.windows {
+		if w.Active(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextStart returns the next time after t that any window starts.
+func (s *schedule) NextStart(t time.Time) time.Time {
+	var next time.Time
+	for _, w := range s.windows {
+		if start := w.nextStart(t); !start.IsZero() && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+	return next
+}
+
+func (s *schedule) String() string {
+	return s.spec
+}
+
+// checkSchedule defers activation of an instance with a schedule while outside
+// the schedule, so it is expected to send heartbeats within its activation
+// duration from the start of the next window. If it was firing it is resolved.
+func (i *instanceDetails) checkSchedule(now time.Time) {
+	if i.Schedule == nil || i.Schedule.Active(now) {
+		i.OutOfSchedule = false
+		return
+	}
+	i.OutOfSchedule = true
+	next := i.Schedule.NextStart(now)
+	if next.IsZero() {
+		return
+	}
+	deferTo := next.Add(i.Activation)
+	if !i.ActivateAt.Before(deferTo) {
+		return
+	}
+	if i.firing(now) && !i.LastSent.IsZero() && !i.LastSent.Before(i.ActivatedAt) {
+		i.ResolvedAt = now
+	}
+	i.HeldFiring = false
+	i.ActivateAt = deferTo
+}
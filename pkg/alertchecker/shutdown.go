@@ -0,0 +1,58 @@
+package alertchecker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+var errShuttingDown = errors.New("shutting down")
+
+// ShutdownHook is called by Shutdown once checking has stopped, with the final
+// state of the instances as served to peers on /-/state, e.g. to persist it.
+type ShutdownHook func(ctx context.Context, state []byte) error
+
+// OnShutdown adds a hook to be called on Shutdown.
+func (ac *AlertChecker) OnShutdown(hook ShutdownHook) {
+	ac.Lock()
+	defer ac.Unlock()
+	ac.shutdownHooks = append(ac.shutdownHooks, hook)
+}
+
+// Shutdown stops Run, waiting for any deliveries in progress to complete,
+// then runs the shutdown hooks. Heartbeats received after Shutdown is called
+// are rejected. If ctx is done first its error is returned, deliveries still in
+// progress may then not complete.
+func (ac *AlertChecker) Shutdown(ctx context.Context) error {
+	ac.stopOnce.Do(func() { close(ac.stopChan) })
+	ac.RLock()
+	running := ac.running
+	ac.RUnlock()
+	if running {
+		select {
+		case <-ac.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	ac.RLock()
+	hooks := ac.shutdownHooks
+	ac.RUnlock()
+	var state bytes.Buffer
+	err := ac.writeState(&state)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		if hookErr := hook(ctx, state.Bytes()); hookErr != nil {
+			slog.ErrorContext(ctx, "Shutdown hook failed", logging.Err(hookErr))
+			err = hookErr
+		}
+	}
+	return err
+}
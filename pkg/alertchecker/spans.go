@@ -0,0 +1,87 @@
+package alertchecker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+
+	"github.com/G-Research/prommsd/pkg/alertmanager"
+)
+
+const (
+	keyAttribute          = attribute.Key("prommsd.instance.key")
+	statusAttribute       = attribute.Key("prommsd.alert.status")
+	deliveryTypeAttribute = attribute.Key("prommsd.delivery.type")
+	destinationAttribute  = attribute.Key("prommsd.delivery.destination")
+	batchSizeAttribute    = attribute.Key("prommsd.delivery.batch_size")
+)
+
+const tracerName = "github.com/G-Research/prommsd/pkg/alertchecker"
+
+// WithTracerProvider creates spans with tp, otherwise the global
+// TracerProvider is used.
+func WithTracerProvider(tp oteltrace.TracerProvider) Option {
+	return func(o *options) {
+		o.tracerProvider = tp
+	}
+}
+
+// WithHTTPClient uses c for all outgoing requests (notifications, recovery
+// and peers), otherwise a client which creates spans and propagates trace
+// context to the receiver is used.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
+
+// setupTracing sets the tracer and HTTP client from the options.
+func (ac *AlertChecker) setupTracing(o *options) {
+	ac.tracerProvider = o.tracerProvider
+	if ac.tracerProvider == nil {
+		ac.tracerProvider = otel.GetTracerProvider()
+	}
+	ac.tracer = ac.tracerProvider.Tracer(tracerName)
+	ac.httpClient = o.httpClient
+	if ac.httpClient == nil {
+		ac.httpClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport, otelhttp.WithTracerProvider(ac.tracerProvider))}
+	}
+}
+
+// alertmanagerClient returns a client for the Alertmanager at u, using the
+// checker's HTTP client, tracing and metrics.
+func (ac *AlertChecker) alertmanagerClient(u *url.URL) *alertmanager.Client {
+	return alertmanager.NewClient(u, ac.httpClient,
+		alertmanager.WithMetrics(ac.amMetrics),
+		alertmanager.WithTracerProvider(ac.tracerProvider))
+}
+
+// startAlertSpan starts a span for sending the alert for an instance, linked
+// to the span of the heartbeat that last refreshed the instance.
+func (ac *AlertChecker) startAlertSpan(ctx context.Context, name string, instance *instanceDetails) (context.Context, oteltrace.Span) {
+	opts := []oteltrace.SpanStartOption{
+		oteltrace.WithAttributes(keyAttribute.String(instance.Key)),
+	}
+	if instance.HeartbeatSpan.IsValid() {
+		opts = append(opts, oteltrace.WithLinks(oteltrace.Link{SpanContext: instance.HeartbeatSpan}))
+	}
+	return ac.tracer.Start(ctx, name, opts...)
+}
+
+// endSpan records err (if any) on span and ends it. The error is redacted as
+// by deliveryError, as spans are exported elsewhere.
+func endSpan(span oteltrace.Span, err error) {
+	if err != nil {
+		msg := deliveryError(err)
+		span.RecordError(errors.New(msg))
+		span.SetStatus(codes.Error, msg)
+	}
+	span.End()
+}
@@ -0,0 +1,121 @@
+package alertchecker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+// stateVersion is the version of the internal state format, it is increased
+// for changes older versions can't read.
+const stateVersion = 1
+
+// state is the full state of the instances, as written on shutdown (see
+// ShutdownHook) and replicated between peers on /-/state. Unlike
+// /api/v1/instances it has everything needed to restore the instances,
+// including destinations and annotations which may contain secrets.
+type state struct {
+	// Version is 0 for state written before it was versioned, which is
+	// otherwise the same as version 1.
+	Version   int                         `json:"version"`
+	Monitored map[string]*instanceDetails `json:"monitored"`
+	Expired   map[string]*instanceDetails `json:"expired"`
+	// Deleted is when instances were deleted, so peers delete them too.
+	Deleted map[string]time.Time `json:"deleted,omitempty"`
+	// The summary alerts, so peers know when they were last sent.
+	Outage    *summaryAlert `json:"outage,omitempty"`
+	Isolation *summaryAlert `json:"isolation,omitempty"`
+}
+
+// writeState writes the monitored and expired instances as JSON. Only copying
+// them is done with the lock held, so checks and heartbeats aren't held up
+// while large state is encoded (or written to a slow peer).
+func (ac *AlertChecker) writeState(w io.Writer) error {
+	ac.RLock()
+	s := state{
+		Version:   stateVersion,
+		Monitored: copyInstances(ac.monitored),
+		Expired:   copyInstances(ac.expired),
+		Deleted:   maps.Clone(ac.deleted),
+		Outage:    ac.outage.copy(),
+		Isolation: ac.isolation.copy(),
+	}
+	ac.RUnlock()
+	return json.NewEncoder(w).Encode(s)
+}
+
+// copyInstances copies instances, see instanceDetails.copy.
+func copyInstances(instances map[string]*instanceDetails) map[string]*instanceDetails {
+	c := make(map[string]*instanceDetails, len(instances))
+	for key, instance := range instances {
+		c[key] = instance.copy()
+	}
+	return c
+}
+
+// copy returns a copy of the instance which can be read without the lock, as
+// instances, including their slices and maps, are updated in place.
+// LastAlert is shared, it is never modified.
+func (i *instanceDetails) copy() *instanceDetails {
+	c := *i
+	c.AlertManagers = slices.Clone(i.AlertManagers)
+	c.OverrideLabels = slices.Clone(i.OverrideLabels)
+	c.Replicas = maps.Clone(i.Replicas)
+	c.QuorumOverrideLabels = slices.Clone(i.QuorumOverrideLabels)
+	c.Intervals = slices.Clone(i.Intervals)
+	c.Transitions = slices.Clone(i.Transitions)
+	return &c
+}
+
+// copy returns a copy of the summary alert which can be read without the lock.
+func (sa *summaryAlert) copy() *summaryAlert {
+	if sa == nil {
+		return nil
+	}
+	c := *sa
+	c.Keys = slices.Clone(sa.Keys)
+	c.AlertManagers = slices.Clone(sa.AlertManagers)
+	return &c
+}
+
+// decodeState reads state written by writeState.
+func decodeState(r io.Reader) (*state, error) {
+	var s state
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	}
+	if s.Version > stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d (want at most %d)", s.Version, stateVersion)
+	}
+	return &s, nil
+}
+
+// Responds to /-/state with the internal state of the instances, for peers.
+// As it includes secrets it is only served to peers, which authenticate with
+// PeerToken.
+func (ac *AlertChecker) stateHandler(w http.ResponseWriter, req *http.Request) {
+	if len(ac.peers) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(ac.config.PeerToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := ac.writeState(w)
+	if err != nil {
+		slog.ErrorContext(req.Context(), "Error serving state", logging.Err(err))
+	}
+}
@@ -2,9 +2,11 @@ package alertchecker
 
 import (
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
 	"time"
+
+	"github.com/G-Research/prommsd/pkg/logging"
 )
 
 const statusTextTemplate = `
@@ -17,6 +19,7 @@ const statusTextTemplate = `
 	th, td { border: 1px solid #aaa; padding: 5px; }
 	tr.good { background-color: #cfc; }
 	tr.alert { background-color: #fcc; }
+	tr.expired { background-color: #ddd; }
 	button.delete { background-color: #fbb; }
 </style>
 
@@ -24,7 +27,7 @@ const statusTextTemplate = `
   async function del(button) {
 		try {
 			let key = button.dataset.key;
-			let r = await fetch("/modify?key=" + encodeURIComponent(key), {
+			let r = await fetch("modify?key=" + encodeURIComponent(key), {
 				method: "DELETE"
 			});
 			if (r.status != 200) {
@@ -44,6 +47,83 @@ const statusTextTemplate = `
 	href="http://github.com/G-Research/prommsd">docs on GitHub</a>.
 </p>
 
+{{ if after .WarmUpUntil .Time }}
+<p>
+	<table>
+		<tr>
+			<td>
+				Warming up for another {{ humanise .WarmUpUntil .Time }}, restored instances won't activate before then.
+			</td>
+		</tr>
+	</table>
+</p>
+{{ end }}
+
+{{ if .Peers }}
+<p>
+	<table>
+		{{ range .Peers }}
+		<tr class="{{ if .Up }}good{{ else }}alert{{ end }}">
+			<td>{{ .URL }}{{ if .Self }} (this replica){{ end }}</td>
+			<td>
+				{{ if not .Up }}
+					Down, last synced {{ humanise $.Time .LastSync }} ago
+				{{ else if eq .URL $.Sender }}
+					Sending notifications
+				{{ else }}
+					Standing by
+				{{ end }}
+				{{ if .LastError }}
+					<br>
+					Last error: {{ .LastError }}
+				{{ end }}
+			</td>
+		</tr>
+		{{ end }}
+	</table>
+</p>
+{{ end }}
+
+{{ with .Isolation }}
+<p>
+	<table>
+		<tr class="{{ if .Active }}alert{{ else }}good{{ end }}">
+			<td>
+				{{ if .Active }}
+					Not receiving any heartbeats, since {{ humanise $.Time $.LastReceived }} ago. Alerting for individual instances is suppressed.
+				{{ else }}
+					Heartbeats received again {{ humanise $.Time .ResolvedAt }} ago.
+				{{ end }}
+				{{ if .LastError}}
+					<br>
+					Last error: {{ .LastError }}
+				{{ end }}
+			</td>
+		</tr>
+	</table>
+</p>
+{{ end }}
+
+{{ with .MassOutage }}
+<p>
+	<table>
+		<tr class="{{ if .Active }}alert{{ else }}good{{ end }}">
+			<td>
+				{{ if .Active }}
+					Mass outage: {{ len .Keys }} instances activated together {{ humanise $.Time .ActivatedAt }} ago.
+				{{ else }}
+					Mass outage resolved {{ humanise $.Time .ResolvedAt }} ago.
+				{{ end }}
+				{{ if .LastError}}
+					<br>
+					Last error: {{ .LastError }}
+				{{ end }}
+			</td>
+		</tr>
+	</table>
+</p>
+{{ end }}
+
 <p>
 	Monitoring {{ len .Monitored }} instances.
 
@@ -56,12 +136,20 @@ const statusTextTemplate = `
 			<th></th>
 		</tr>
 		{{ range $key, $value := .Monitored }}
-		<tr class="{{ if after $.Time .ActivateAt }}alert{{ else }}good{{ end }}">
+		<tr class="{{ if or (after $.Time .ActivateAt) .HeldFiring }}alert{{ else }}good{{ end }}">
 			<td>{{ $key }}</td>
 			<td><a href="{{ .LastAlert.GeneratorURL }}">Graph</a></td>
 			<td>
 				{{ if after $.Time .ActivateAt }}
 					Activated {{ humanise $.Time .ActivateAt }} ago
+					{{ if .Suppressed }}
+						<br>
+						Suppressed by {{ if $.Isolation }}isolation{{ else }}mass outage{{ end }} alert
+					{{ end }}
+					{{ if .InhibitedBy }}
+						<br>
+						Inhibited by {{ .InhibitedBy }}
+					{{ end }}
 				{{ else }}
 					Activate in {{ humanise $.Time .ActivateAt }}
 				{{ if after .ActivatedAt $.Zero }}
@@ -81,6 +169,42 @@ const statusTextTemplate = `
 					<br>
 					Last error: {{ .LastError }}
 				{{ end }}
+				{{ if .DeliveryLag }}
+					<br>
+					Last heartbeat delivery lag: {{ .DeliveryLag }}
+				{{ end }}
+				{{ if .Schedule }}
+					<br>
+					Schedule: {{ .Schedule }}{{ if .OutOfSchedule }} (outside schedule, not alerting){{ end }}
+				{{ end }}
+				{{ if .Flapping }}
+					<br>
+					Flapping ({{ len .Transitions }} transitions){{ if .HeldFiring }}, held firing{{ end }}
+				{{ end }}
+				{{ if .Adaptive }}
+					<br>
+					Activation: configured {{ .Activation }},
+					{{ if .LearnedActivation }}
+						learned {{ .LearnedActivation }} (from {{ len .Intervals }} heartbeats)
+					{{ else }}
+						learning ({{ len .Intervals }} heartbeats seen)
+					{{ end }}
+				{{ end }}
+				{{ if .Replicas }}
+					<br>
+					Replicas:
+					{{ range $replica, $activateAt := .Replicas }}
+						{{ $replica }} ({{ if after $activateAt $.Time }}ok{{ else }}missing for {{ humanise $.Time $activateAt }}{{ end }})
+					{{ end }}
+					{{ if .Degraded }}
+						<br>
+						Below quorum of {{ .Quorum }} for {{ humanise $.Time .DegradedAt }}
+					{{ end }}
+					{{ if .DegradedLastError }}
+						<br>
+						Last quorum alert error: {{ .DegradedLastError }}
+					{{ end }}
+				{{ end }}
 			</td>
 			<td>
 			  <button class="delete" data-key="{{$key}}" onclick="del(this)">Delete</button>
@@ -90,6 +214,72 @@ const statusTextTemplate = `
 	</table>
 {{ end }}
 
+{{ if len .Unarmed }}
+<p>
+	{{ len .Unarmed }} instances not yet armed (these will not alert and are removed if heartbeats stop).
+
+	<table>
+		<tr>
+			<th>Key</th>
+			<th>Graph</th>
+			<th>Status</th>
+			<th></th>
+		</tr>
+		{{ range $key, $value := .Unarmed }}
+		<tr>
+			<td>{{ $key }}</td>
+			<td><a href="{{ .LastAlert.GeneratorURL }}">Graph</a></td>
+			<td>
+				First seen {{ humanise $.Time .FirstSeen }} ago, {{ .Heartbeats }} heartbeats received
+				{{ if .ArmAfterCount }}
+					<br>
+					Arms after {{ .ArmAfterCount }} heartbeats
+				{{ end }}
+				{{ if .ArmAfterDuration }}
+					<br>
+					Arms after being seen for {{ .ArmAfterDuration }}
+				{{ end }}
+			</td>
+			<td>
+			  <button class="delete" data-key="{{$key}}" onclick="del(this)">Delete</button>
+			</td>
+		</tr>
+		{{ end }}
+	</table>
+</p>
+{{ end }}
+
+{{ if len .Expired }}
+<p>
+	Expired {{ len .Expired }} instances (shown for {{ .ExpiredRetention }} after expiry, no longer alerting).
+
+	<table>
+		<tr>
+			<th>Key</th>
+			<th>Graph</th>
+			<th>Status</th>
+			<th></th>
+		</tr>
+		{{ range $key, $value := .Expired }}
+		<tr class="expired">
+			<td>{{ $key }}</td>
+			<td><a href="{{ .LastAlert.GeneratorURL }}">Graph</a></td>
+			<td>
+				Expired {{ humanise $.Time .ExpiredAt }} ago, after alerting for {{ humanise .ExpiredAt .ActivateAt }}
+				{{ if .LastError}}
+					<br>
+					Last error: {{ .LastError }}
+				{{ end }}
+			</td>
+			<td>
+			  <button class="delete" data-key="{{$key}}" onclick="del(this)">Delete</button>
+			</td>
+		</tr>
+		{{ end }}
+	</table>
+</p>
+{{ end }}
+
 <p>
 	Debug info:
 	<ul>
@@ -110,14 +300,38 @@ func (ac *AlertChecker) status(w http.ResponseWriter, req *http.Request) {
 	ac.RLock()
 	defer ac.RUnlock()
 
+	monitored := map[string]*instanceDetails{}
+	unarmed := map[string]*instanceDetails{}
+	for key, instance := range ac.monitored {
+		if instance.Armed {
+			monitored[key] = instance
+		} else {
+			unarmed[key] = instance
+		}
+	}
+
+	now := ac.now()
+	var sender string
+	if p := ac.currentSender(now); p != nil {
+		sender = p.url
+	}
 	err := statusTemplate.Execute(w, map[string]interface{}{
-		"Monitored": ac.monitored,
-		"Time":      time.Now(),
-		"Zero":      time.Unix(0, 0),
+		"Monitored":        monitored,
+		"Unarmed":          unarmed,
+		"Expired":          ac.expired,
+		"MassOutage":       ac.outage,
+		"Isolation":        ac.isolation,
+		"LastReceived":     ac.lastReceived,
+		"WarmUpUntil":      ac.warmUpUntil,
+		"Peers":            ac.peerStatus(now),
+		"Sender":           sender,
+		"ExpiredRetention": ac.config.ExpiredRetention,
+		"Time":             time.Now(),
+		"Zero":             time.Unix(0, 0),
 	})
 
 	if err != nil {
-		log.Printf("Error serving status: %v", err)
+		slog.ErrorContext(req.Context(), "Error serving status", logging.Err(err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -128,7 +342,9 @@ func (ac *AlertChecker) modify(w http.ResponseWriter, req *http.Request) {
 	defer ac.Unlock()
 
 	key := req.FormValue("key")
-	if _, ok := ac.monitored[key]; !ok {
+	_, monitored := ac.monitored[key]
+	_, expired := ac.expired[key]
+	if !monitored && !expired {
 		http.Error(w, "Key does not exist", http.StatusBadRequest)
 		return
 	}
@@ -139,6 +355,9 @@ func (ac *AlertChecker) modify(w http.ResponseWriter, req *http.Request) {
 	}
 
 	delete(ac.monitored, key)
+	delete(ac.expired, key)
+	ac.deadlines.remove(key)
+	ac.deleted[key] = ac.now()
 	w.Write([]byte("ok"))
 }
 
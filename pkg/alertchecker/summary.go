@@ -0,0 +1,115 @@
+package alertchecker
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+
+	"github.com/G-Research/prommsd/pkg/alertmanager"
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+// summaryAlert is a single alert sent instead of (or as well as) the alerts
+// for many instances, e.g. for a mass outage.
+type summaryAlert struct {
+	AlertName             string
+	Summary, Description  string
+	ActivatedAt, LastSent time.Time
+	ResolvedAt            time.Time
+	// Keys of the instances covered by this alert.
+	Keys          []string
+	AlertManagers []string
+	Receiver      string
+	LastError     string
+}
+
+// Active returns true if the summary alert is firing.
+func (sa *summaryAlert) Active() bool {
+	return sa.ResolvedAt.IsZero()
+}
+
+// update sets the keys and destinations of the alert from the affected
+// instances.
+func (sa *summaryAlert) update(monitored map[string]*instanceDetails, affected map[string]bool) {
+	sa.Keys = sa.Keys[:0]
+	for key := range affected {
+		sa.Keys = append(sa.Keys, key)
+	}
+	sort.Strings(sa.Keys)
+
+	// Send to every destination any of the instances would send to, once.
+	seen := map[string]bool{}
+	sa.AlertManagers = sa.AlertManagers[:0]
+	for _, key := range sa.Keys {
+		instance := monitored[key]
+		if sa.Receiver == "" {
+			sa.Receiver = instance.Receiver
+		}
+		for _, am := range instance.AlertManagers {
+			if !seen[am] {
+				seen[am] = true
+				sa.AlertManagers = append(sa.AlertManagers, am)
+			}
+		}
+	}
+}
+
+// unsuppress clears Suppressed on the instances covered by the alert which
+// aren't in keep, as instances which aren't due for a check would otherwise
+// keep showing as suppressed.
+func (sa *summaryAlert) unsuppress(monitored map[string]*instanceDetails, keep map[string]bool) {
+	for _, key := range sa.Keys {
+		if instance, ok := monitored[key]; ok && !keep[key] {
+			instance.Suppressed = false
+		}
+	}
+}
+
+// alertSummary makes the alert to send for a summary alert. Must be called
+// with the lock held.
+func (ac *AlertChecker) alertSummary(ctx context.Context, now time.Time, sa *summaryAlert) *outgoing {
+	ctx = logging.NewContext(ctx, slog.String("alertname", sa.AlertName))
+	ctx, span := ac.tracer.Start(ctx, "alertchecker.alertSummary",
+		oteltrace.WithAttributes(attribute.String("prommsd.alertname", sa.AlertName)))
+
+	alert := alertmanager.NewAlert()
+	alert.Labels["alertname"] = sa.AlertName
+	alert.Labels["severity"] = "critical"
+	alert.Annotations["summary"] = sa.Summary
+	alert.Annotations["description"] = sa.Description
+	alert.GeneratorURL = ac.externalURL
+	alert.StartsAt = sa.ActivatedAt
+	alert.Status = "firing"
+	if !sa.Active() {
+		alert.EndsAt = sa.ResolvedAt
+		alert.Status = "resolved"
+	}
+
+	groupLabels := map[string]string{"alertname": sa.AlertName}
+	span.SetAttributes(statusAttribute.String(alert.Status))
+	sk := sendingKey{"summary", sa.AlertName}
+	ac.sending[sk] = true
+	return &outgoing{
+		ctx:          ctx,
+		alert:        alert,
+		groupLabels:  groupLabels,
+		destinations: sa.AlertManagers,
+		receiver:     sa.Receiver,
+		lastSent:     sa.LastSent,
+		done: func(err error) {
+			endSpan(span, err)
+			ac.Lock()
+			defer ac.Unlock()
+			delete(ac.sending, sk)
+			if err != nil {
+				sa.LastError = deliveryError(err)
+			} else {
+				sa.LastSent = now
+			}
+		},
+	}
+}
@@ -0,0 +1,106 @@
+package alertchecker
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/G-Research/prommsd/pkg/logging"
+)
+
+const warmUpReason = "warm-up"
+
+// Restore adds the instances in state, as written on shutdown (see
+// ShutdownHook), which aren't already known. During the warm-up restored
+// instances don't activate until it is over, unless they were already firing,
+// so Alertmanager has a chance to deliver heartbeats again first.
+func (ac *AlertChecker) Restore(state []byte) error {
+	s, err := decodeState(bytes.NewReader(state))
+	if err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+
+	ac.Lock()
+	defer ac.Unlock()
+	now := ac.now()
+	restored := 0
+	for key, instance := range s.Monitored {
+		if _, ok := ac.monitored[key]; ok {
+			continue
+		}
+		ac.restoreSchedule(key, instance)
+		ac.monitored[key] = instance
+		ac.deferForWarmUp(instance, now)
+		ac.deadlines.set(key, ac.nextCheck(instance, now, 0))
+		restored++
+	}
+	for key, instance := range s.Expired {
+		if _, ok := ac.monitored[key]; ok {
+			continue
+		}
+		if _, ok := ac.expired[key]; !ok {
+			ac.expired[key] = instance
+		}
+	}
+	ac.metrics.instances.Set(float64(len(ac.monitored)))
+	slog.Info("Restored instances", slog.Int("monitored", restored), slog.Time("warm_up_until", ac.warmUpUntil))
+	return nil
+}
+
+// restoreSchedule sets the schedule of an instance decoded from JSON, which
+// only has the msd_schedule annotation.
+func (ac *AlertChecker) restoreSchedule(key string, instance *instanceDetails) {
+	if instance.LastAlert == nil {
+		return
+	}
+	if spec, ok := instance.LastAlert.GetAnnotation("msd_schedule"); ok {
+		sched, err := ac.getSchedule(spec)
+		if err != nil {
+			slog.Warn("Failed to parse msd_schedule, alerting at all times", slog.String(logging.KeyInstance, key), logging.Err(err))
+		}
+		instance.Schedule = sched
+	}
+}
+
+// startWarmUp starts the warm-up, deferring the activation of instances
+// restored before starting. Must be called with the lock held.
+func (ac *AlertChecker) startWarmUp(now time.Time) {
+	if ac.config.WarmUp <= 0 {
+		return
+	}
+	ac.warmUpUntil = now.Add(ac.config.WarmUp)
+	ac.notReady[warmUpReason] = true
+	for key, instance := range ac.monitored {
+		ac.deferForWarmUp(instance, now)
+		ac.deadlines.set(key, ac.nextCheck(instance, now, 0))
+	}
+	slog.Info("Warming up", slog.Time("until", ac.warmUpUntil))
+}
+
+// checkWarmUp ends the warm-up once it is over. Must be called with the lock
+// held.
+func (ac *AlertChecker) checkWarmUp(now time.Time) {
+	if ac.notReady[warmUpReason] && !now.Before(ac.warmUpUntil) {
+		delete(ac.notReady, warmUpReason)
+		slog.Info("Warm-up complete")
+	}
+}
+
+// warmingUp returns true during the warm-up. Must be called with the lock
+// held.
+func (ac *AlertChecker) warmingUp(now time.Time) bool {
+	return now.Before(ac.warmUpUntil)
+}
+
+// deferForWarmUp defers the activation of a restored instance to the end of
+// the warm-up, unless it was already firing. Must be called with the lock
+// held.
+func (ac *AlertChecker) deferForWarmUp(instance *instanceDetails, now time.Time) {
+	if !ac.warmingUp(now) {
+		return
+	}
+	if instance.LastSent.Before(instance.ActivateAt) && instance.ActivateAt.Before(ac.warmUpUntil) {
+		instance.ActivateAt = ac.warmUpUntil
+	}
+}
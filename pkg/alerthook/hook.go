@@ -4,34 +4,23 @@ package alerthook
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/G-Research/prommsd/pkg/alertmanager"
+	"github.com/G-Research/prommsd/pkg/logging"
 )
 
-var (
-	receivedMetric = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Namespace: "prommsd",
-			Subsystem: "alerthook",
-			Name:      "received_total",
-		})
-	errorsMetric = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "prommsd",
-			Subsystem: "alerthook",
-			Name:      "errors_total",
-		}, []string{"type"})
-)
+// ErrOverloaded is returned (possibly wrapped) by an AlertHandler that can't
+// accept alerts right now. The sender is asked to retry after
+// OverloadedRetryAfter, rather than given an error.
+var ErrOverloaded = errors.New("overloaded, retry later")
 
-func init() {
-	for _, errorType := range []string{"wrong_method", "decode", "handler"} {
-		errorsMetric.With(prometheus.Labels{"type": errorType}).Add(0)
-	}
-}
+// OverloadedRetryAfter is sent in the Retry-After header when overloaded.
+const OverloadedRetryAfter = "5"
 
 // AlertHandler should be implemented by clients wishing to receive the alerts
 // from the hook.
@@ -40,33 +29,66 @@ type AlertHandler interface {
 	Healthy() bool
 }
 
+// ReadyChecker may be implemented by an AlertHandler to report whether it is
+// ready on '/-/ready', otherwise it is ready when healthy.
+type ReadyChecker interface {
+	Ready() bool
+}
+
 type AlertHook struct {
-	handler AlertHandler
+	handler        AlertHandler
+	receivedMetric prometheus.Counter
+	errorsMetric   *prometheus.CounterVec
 }
 
+// New returns an AlertHook passing alerts to handler. Its metrics are
+// registered on registerer, unless it is nil.
 func New(handler AlertHandler, registerer prometheus.Registerer) *AlertHook {
-	if registerer != nil {
-		registerer.MustRegister(receivedMetric)
-		registerer.MustRegister(errorsMetric)
-	}
-	return &AlertHook{
+	ah := &AlertHook{
 		handler: handler,
+		receivedMetric: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "prommsd",
+				Subsystem: "alerthook",
+				Name:      "received_total",
+			}),
+		errorsMetric: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "prommsd",
+				Subsystem: "alerthook",
+				Name:      "errors_total",
+			}, []string{"type"}),
+	}
+	for _, errorType := range []string{"wrong_method", "decode", "handler", "overloaded"} {
+		ah.errorsMetric.With(prometheus.Labels{"type": errorType}).Add(0)
 	}
+	if registerer != nil {
+		registerer.MustRegister(ah.receivedMetric)
+		registerer.MustRegister(ah.errorsMetric)
+	}
+	return ah
 }
 
 func (ah *AlertHook) Healthy() bool {
 	return ah.handler.Healthy()
 }
 
+func (ah *AlertHook) Ready() bool {
+	if rc, ok := ah.handler.(ReadyChecker); ok {
+		return rc.Ready()
+	}
+	return ah.handler.Healthy()
+}
+
 func (ah *AlertHook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.Method == "HEAD" || req.Method == "OPTIONS" {
 		return
 	}
 
-	receivedMetric.Add(1)
+	ah.receivedMetric.Add(1)
 
 	if req.Method != "POST" {
-		errorsMetric.With(prometheus.Labels{"type": "wrong_method"}).Add(1)
+		ah.errorsMetric.With(prometheus.Labels{"type": "wrong_method"}).Add(1)
 		http.Error(w, "Expected alert to be POSTed", http.StatusBadRequest)
 		return
 	}
@@ -76,8 +98,8 @@ func (ah *AlertHook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	var m alertmanager.Message
 	err := json.NewDecoder(req.Body).Decode(&m)
 	if err != nil {
-		errorsMetric.With(prometheus.Labels{"type": "decode"}).Add(1)
-		log.Printf("Error decoding alert: %v", err)
+		ah.errorsMetric.With(prometheus.Labels{"type": "decode"}).Add(1)
+		slog.WarnContext(req.Context(), "Error decoding alert", logging.Err(err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -87,15 +109,21 @@ func (ah *AlertHook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		alert.Parent = &m
 		maybeErr := ah.handler.HandleAlert(req.Context(), alert)
 		if maybeErr != nil {
-			log.Printf("Error handling alert (%q:%d): %v", m.GroupKey, i, maybeErr)
+			slog.ErrorContext(req.Context(), "Error handling alert", slog.String("group_key", m.GroupKey), slog.Int("index", i), logging.Err(maybeErr))
 		}
 		if maybeErr != nil && err == nil {
 			err = maybeErr
 		}
 	}
 
+	if errors.Is(err, ErrOverloaded) {
+		ah.errorsMetric.With(prometheus.Labels{"type": "overloaded"}).Add(1)
+		w.Header().Set("Retry-After", OverloadedRetryAfter)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
-		errorsMetric.With(prometheus.Labels{"type": "handle"}).Add(1)
+		ah.errorsMetric.With(prometheus.Labels{"type": "handle"}).Add(1)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
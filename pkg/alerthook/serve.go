@@ -1,8 +1,10 @@
 package alerthook
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -12,14 +14,44 @@ import (
 
 // Serve provides an alertmanager webhook server. It registers a handler on
 // '/alert' to receive alerts. It also registers handlers for '/metrics'
-// (Prometheus metrics) and '/-/healthy' (health checking).
+// (Prometheus metrics), '/-/healthy' (health checking) and '/-/ready'
+// (readiness checking).
 //
-// Alerts are forwarded to the provided AlertHandler.
-func Serve(listenAddr string, alertHandler AlertHandler, registerer prometheus.Registerer) {
+// Alerts are forwarded to the provided AlertHandler. If statusHandler is not
+// nil it serves all other paths. (Go's x/net/trace pages are also served.)
+//
+// Serve runs until ctx is done, then stops accepting connections and waits up
+// to drainTimeout for requests in progress to complete.
+func Serve(ctx context.Context, listenAddr string, alertHandler AlertHandler, statusHandler http.Handler, registerer prometheus.Registerer, drainTimeout time.Duration) error {
 	handler := New(alertHandler, registerer)
-	registerHandlers(http.DefaultServeMux, handler)
-	log.Print("Starting HTTP server on ", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, tracing(http.DefaultServeMux)))
+	mux := http.NewServeMux()
+	registerHandlers(mux, handler)
+	if statusHandler != nil {
+		mux.Handle("/", statusHandler)
+	}
+	// x/net/trace registers its pages on the default mux.
+	mux.Handle("/debug/", http.DefaultServeMux)
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: tracing(mux),
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		slog.Info("Starting HTTP server", slog.String("listen", listenAddr))
+		errChan <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down HTTP server", slog.Duration("drain_timeout", drainTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
 }
 
 func registerHandlers(serveMux *http.ServeMux, handler *AlertHook) {
@@ -33,6 +65,14 @@ func registerHandlers(serveMux *http.ServeMux, handler *AlertHook) {
 		}
 		w.Write([]byte("ok"))
 	})
+
+	serveMux.HandleFunc("/-/ready", func(w http.ResponseWriter, req *http.Request) {
+		if !handler.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
 }
 
 // tracing adds a context with tracing to requests that pass through it
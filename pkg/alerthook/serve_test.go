@@ -3,12 +3,15 @@ package alerthook
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
@@ -34,7 +37,7 @@ func (h *MockHandler) Healthy() bool {
 func TestHandlers(t *testing.T) {
 	mux := http.NewServeMux()
 	mock := &MockHandler{}
-	handler := New(mock, prometheus.DefaultRegisterer)
+	handler := New(mock, prometheus.NewRegistry())
 	registerHandlers(mux, handler)
 
 	doRequest := func(method, path string, body io.Reader, wantStatus int) *http.Response {
@@ -57,6 +60,12 @@ func TestHandlers(t *testing.T) {
 		t.Errorf("/-/healthy: got %q, want %q", string(body), "ok")
 	}
 
+	// MockHandler isn't a ReadyChecker, so is ready when healthy.
+	res = doRequest("GET", "/-/ready", nil, http.StatusOK)
+	if body, _ := ioutil.ReadAll(res.Body); string(body) != "ok" {
+		t.Errorf("/-/ready: got %q, want %q", string(body), "ok")
+	}
+
 	res = doRequest("GET", "/metrics", nil, http.StatusOK)
 	if body, _ := ioutil.ReadAll(res.Body); !strings.Contains(string(body), "promhttp_metric_handler_requests_total") {
 		t.Errorf("/metrics: got %q, want string containing promhttp_metric_handler_requests_total", string(body))
@@ -99,4 +108,107 @@ func TestHandlers(t *testing.T) {
 	if body, _ := ioutil.ReadAll(res.Body); strings.Contains(string(body), "test error 2") {
 		t.Errorf("/alert: got %q, want string containing %q", string(body), "test error 2")
 	}
+
+	// Handler overloaded, asks for a retry
+	mock.Err = fmt.Errorf("queue full: %w", ErrOverloaded)
+	res = doRequest("POST", "/alert",
+		strings.NewReader(`{"alerts":[{"labels":{"foo":"bar"}}]}`),
+		http.StatusServiceUnavailable)
+	if got := res.Header.Get("Retry-After"); got != OverloadedRetryAfter {
+		t.Errorf("/alert: got Retry-After %q, want %q", got, OverloadedRetryAfter)
+	}
+}
+
+type blockingHandler struct {
+	MockHandler
+	started, release chan struct{}
+}
+
+func (h *blockingHandler) HandleAlert(ctx context.Context, alert *alertmanager.Alert) error {
+	close(h.started)
+	<-h.release
+	return nil
+}
+
+func TestServeShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	handler := &blockingHandler{started: make(chan struct{}), release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- Serve(ctx, addr, handler, nil, prometheus.NewRegistry(), 5*time.Second)
+	}()
+
+	posted := make(chan error)
+	go func() {
+		var res *http.Response
+		var err error
+		// Wait for the server to be listening.
+		for i := 0; i < 50; i++ {
+			res, err = http.Post("http://"+addr+"/alert", "application/json",
+				strings.NewReader(`{"alerts":[{"labels":{"foo":"bar"}}]}`))
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				err = errors.New(res.Status)
+			}
+		}
+		posted <- err
+	}()
+
+	select {
+	case <-handler.started:
+	case err := <-posted:
+		t.Fatalf("request not handled: %v", err)
+	}
+	cancel()
+
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned (%v) with request in progress", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(handler.release)
+	if err := <-posted; err != nil {
+		t.Errorf("request in progress on shutdown failed: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
+
+func TestMetricsPerHook(t *testing.T) {
+	// Each hook has its own metrics, so several can be registered.
+	reg := prometheus.NewRegistry()
+	a := New(&MockHandler{}, reg)
+	b := New(&MockHandler{}, prometheus.NewRegistry())
+
+	a.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/alert", strings.NewReader(`{"alerts":[]}`)))
+	b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/alert", strings.NewReader(`{"alerts":[]}`)))
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "prommsd_alerthook_received_total" {
+			if got := family.GetMetric()[0].GetCounter().GetValue(); got != 1 {
+				t.Errorf("got %v received, want 1", got)
+			}
+			return
+		}
+	}
+	t.Errorf("got no received metric")
 }
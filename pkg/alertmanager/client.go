@@ -6,68 +6,190 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
-)
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
-var (
-	sentMetric = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Namespace: "prommsd",
-			Subsystem: "alertmanager",
-			Name:      "sent_total",
-		})
-	errorsMetric = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "prommsd",
-			Subsystem: "alertmanager",
-			Name:      "errors_total",
-		}, []string{"type"})
+	"github.com/G-Research/prommsd/pkg/logging"
 )
 
-func init() {
-	prometheus.MustRegister(sentMetric)
-	prometheus.MustRegister(errorsMetric)
+// Metrics are metrics for alerts sent by clients. A Metrics is a
+// prometheus.Collector, to be registered by the caller.
+type Metrics struct {
+	sent   prometheus.Counter
+	errors *prometheus.CounterVec
+}
+
+// NewMetrics returns new Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		sent: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: "prommsd",
+				Subsystem: "alertmanager",
+				Name:      "sent_total",
+			}),
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "prommsd",
+				Subsystem: "alertmanager",
+				Name:      "errors_total",
+			}, []string{"type"}),
+	}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.sent.Describe(ch)
+	m.errors.Describe(ch)
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.sent.Collect(ch)
+	m.errors.Collect(ch)
 }
 
+func (m *Metrics) incSent() {
+	if m != nil {
+		m.sent.Add(1)
+	}
+}
+
+func (m *Metrics) incError(errorType string) {
+	if m != nil {
+		m.errors.With(prometheus.Labels{"type": errorType}).Add(1)
+	}
+}
+
+const tracerName = "github.com/G-Research/prommsd/pkg/alertmanager"
+
 type Client struct {
-	baseURL url.URL
+	baseURL    url.URL
+	alertsURL  url.URL
+	metrics    *Metrics
+	httpClient *http.Client
+	tracer     trace.Tracer
+}
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// WithMetrics records metrics for the client's requests in m.
+func WithMetrics(m *Metrics) ClientOption {
+	return func(c *Client) {
+		c.metrics = m
+	}
 }
 
-func NewClient(baseURL *url.URL) *Client {
+// WithTracerProvider creates the client's spans with tp, rather than the
+// global TracerProvider.
+func WithTracerProvider(tp trace.TracerProvider) ClientOption {
+	return func(c *Client) {
+		c.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// NewClient returns a client for the Alertmanager at baseURL, making requests
+// with hc (e.g. one which traces them, see otelhttp).
+func NewClient(baseURL *url.URL, hc *http.Client, opts ...ClientOption) *Client {
 	u := *baseURL
 	if u.Path == "" || u.Path == "/" {
 		u.Path = "/api/v1/alerts"
 	}
-	return &Client{
-		baseURL: u,
+	// Alerts are fetched from the v2 API under the same prefix.
+	a := u
+	a.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/api/v1/alerts") + "/api/v2/alerts"
+	c := &Client{
+		baseURL:    u,
+		alertsURL:  a,
+		httpClient: hc,
+		tracer:     otel.Tracer(tracerName),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
-func (c *Client) SendAlerts(ctx context.Context, alerts []Alert) error {
-	sentMetric.Add(1)
+func (c *Client) SendAlerts(ctx context.Context, alerts []Alert) (err error) {
+	ctx, span := c.tracer.Start(ctx, "alertmanager.SendAlerts")
+	span.SetAttributes(attribute.Int("prommsd.alerts", len(alerts)))
+	defer func() { endSpan(span, err) }()
+
+	c.metrics.incSent()
 	body, err := json.Marshal(alerts)
 	if err != nil {
-		errorsMetric.With(prometheus.Labels{"type": "json_encode"}).Add(1)
+		c.metrics.incError("json_encode")
 		return err
 	}
-	req, err := http.NewRequest("POST", c.baseURL.String(), bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL.String(), bytes.NewBuffer(body))
 	if err != nil {
-		errorsMetric.With(prometheus.Labels{"type": "make_request"}).Add(1)
+		c.metrics.incError("make_request")
 		return err
 	}
-	req = req.WithContext(ctx)
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		errorsMetric.With(prometheus.Labels{"type": "http_send"}).Add(1)
+		c.metrics.incError("http_send")
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusOK {
+		slog.DebugContext(ctx, "Sent alerts to Alertmanager", logging.Destination(&c.baseURL), slog.Int("alerts", len(alerts)))
 		return nil
 	}
-	errorsMetric.With(prometheus.Labels{"type": "http_response"}).Add(1)
+	c.metrics.incError("http_response")
 	return errors.New(resp.Status)
 }
+
+// GetAlerts returns the alerts Alertmanager currently has, from its
+// /api/v2/alerts API.
+func (c *Client) GetAlerts(ctx context.Context) (alerts []APIAlert, err error) {
+	ctx, span := c.tracer.Start(ctx, "alertmanager.GetAlerts")
+	defer func() { endSpan(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.alertsURL.String(), nil)
+	if err != nil {
+		c.metrics.incError("make_request")
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		c.metrics.incError("http_send")
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.metrics.incError("http_response")
+		return nil, errors.New(resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&alerts); err != nil {
+		c.metrics.incError("json_decode")
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("prommsd.alerts", len(alerts)))
+	slog.DebugContext(ctx, "Fetched alerts from Alertmanager", logging.Destination(&c.alertsURL), slog.Int("alerts", len(alerts)))
+	return alerts, nil
+}
+
+// endSpan records err (if any) on span and ends it. The URL of a url.Error is
+// left out, as it may contain secrets.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = fmt.Errorf("%s: %w", ue.Op, ue.Err)
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -116,3 +116,48 @@ func (a *Alert) GetAnnotations() map[string]string {
 	}
 	return l
 }
+
+// APIAlert is an alert as returned by Alertmanager's /api/v2/alerts API.
+type APIAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	UpdatedAt    time.Time         `json:"updatedAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+	Receivers    []APIReceiver     `json:"receivers"`
+	Status       APIAlertStatus    `json:"status"`
+}
+
+type APIReceiver struct {
+	Name string `json:"name"`
+}
+
+// APIAlertStatus is the state of an alert in Alertmanager, "active",
+// "suppressed" (silenced or inhibited) or "unprocessed".
+type APIAlertStatus struct {
+	State       string   `json:"state"`
+	SilencedBy  []string `json:"silencedBy"`
+	InhibitedBy []string `json:"inhibitedBy"`
+}
+
+// Alert converts a to an Alert as received by a webhook from the Alertmanager
+// at externalURL.
+func (a *APIAlert) Alert(externalURL string) *Alert {
+	alert := NewAlert()
+	for k, v := range a.Labels {
+		alert.Labels[k] = v
+	}
+	for k, v := range a.Annotations {
+		alert.Annotations[k] = v
+	}
+	alert.StartsAt = a.StartsAt
+	alert.EndsAt = a.EndsAt
+	alert.GeneratorURL = a.GeneratorURL
+	alert.Parent = &Message{ExternalURL: externalURL}
+	if len(a.Receivers) > 0 {
+		alert.Parent.Receiver = a.Receivers[0].Name
+	}
+	return &alert
+}
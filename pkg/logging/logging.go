@@ -0,0 +1,141 @@
+// Package logging configures structured logging for prommsd.
+//
+// All packages log via log/slog using the field names defined here, so log
+// pipelines can filter on them consistently.
+package logging
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Field names used across prommsd.
+const (
+	// KeyInstance is the key of the monitored instance.
+	KeyInstance = "instance"
+	// KeyDestination is the (redacted) URL a notification is sent to.
+	KeyDestination = "destination"
+	// KeyStatus is the status of a notification (firing, resolved, ...).
+	KeyStatus = "status"
+	// KeyError is the error, if any.
+	KeyError = "error"
+	// KeyTraceID and KeySpanID identify the current span, when tracing.
+	KeyTraceID = "trace_id"
+	KeySpanID  = "span_id"
+)
+
+// Config is the logging settings.
+type Config struct {
+	// Level is the minimum level to log: debug, info, warn or error.
+	Level string
+	// Format is the output format: text or json.
+	Format string
+}
+
+// DefaultConfig returns the default settings, logging at info as text.
+func DefaultConfig() Config {
+	return Config{Level: "info", Format: "text"}
+}
+
+// RegisterFlags registers -log-level and -log-format on fs, setting c.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Level, "log-level", c.Level, "Minimum level to log: debug, info, warn or error")
+	fs.StringVar(&c.Format, "log-format", c.Format, "Log output format: text or json")
+}
+
+// Setup sets the default slog logger (which log.Printf also goes to) based on
+// c.
+func Setup(w io.Writer, c Config) error {
+	handler, err := NewHandler(w, c.Format, c.Level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// NewHandler returns a slog.Handler writing in the given format ("text" or
+// "json") at or above the given level. Records logged with a context
+// containing a span get trace and span IDs added.
+func NewHandler(w io.Writer, format, level string) (slog.Handler, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return traceHandler{handler}, nil
+}
+
+// Err returns an attribute for err.
+func Err(err error) slog.Attr {
+	return slog.Any(KeyError, err)
+}
+
+// Destination returns an attribute for a destination URL, redacted by
+// RedactURL.
+func Destination(u *url.URL) slog.Attr {
+	return slog.String(KeyDestination, RedactURL(u))
+}
+
+// RedactURL returns just the scheme and host of u, as user info, the path
+// (e.g. of a webhook) and the query often contain credentials. It is how
+// destinations are shown everywhere: logs, spans, metric labels and the API.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	r := url.URL{Scheme: u.Scheme, Host: u.Host}
+	return r.String()
+}
+
+type attrsKey struct{}
+
+// NewContext returns a context carrying attrs, which are added to any record
+// logged with it (e.g. the instance key while sending its notifications).
+func NewContext(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return context.WithValue(ctx, attrsKey{}, append(existing[:len(existing):len(existing)], attrs...))
+}
+
+// traceHandler adds the attributes and trace and span IDs from the context to
+// records.
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(attrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(
+			slog.String(KeyTraceID, sc.TraceID().String()),
+			slog.String(KeySpanID, sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
@@ -3,6 +3,7 @@ package tracing
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"os"
 	"strings"
 
@@ -66,6 +67,7 @@ func NewProcessorsFromEnv(ctx context.Context) ([]sdktrace.SpanProcessor, error)
 		if new, ok := newExporters[name]; ok {
 			if exporter, err := new(ctx); err == nil {
 				spanProcessors = append(spanProcessors, sdktrace.NewBatchSpanProcessor(exporter))
+				slog.InfoContext(ctx, "Tracing exporter enabled", slog.String("exporter", name))
 			} else {
 				return nil, fmt.Errorf("failed to create exporter \"%s\": %w", name, err)
 			}